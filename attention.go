@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gpuNeedsAttention = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gpu_needs_attention",
+		Help: "1 when the GPU shows a condition that requires a reset or RMA, by reason",
+	},
+	[]string{"gpu_index", "gpu_uuid", "reason"},
+)
+
+// attentionCondition is a health check that, when it holds, means the GPU
+// should be drained and reset or replaced. check returns NOT_SUPPORTED on
+// GPUs that can't report the condition.
+type attentionCondition struct {
+	reason string
+	check  func(device nvml.Device) (bool, nvml.Return)
+}
+
+var attentionConditions = []attentionCondition{
+	{
+		// Uncorrectable errors since the last driver reload
+		reason: "uncorrected_ecc",
+		check: func(device nvml.Device) (bool, nvml.Return) {
+			count, ret := device.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.VOLATILE_ECC)
+			return ret == nvml.SUCCESS && count >= *attentionEccThreshold, ret
+		},
+	},
+	{
+		// Pages waiting to be retired on the next reset (pre-Ampere)
+		reason: "retired_pages_pending",
+		check: func(device nvml.Device) (bool, nvml.Return) {
+			pending, ret := device.GetRetiredPagesPendingStatus()
+			return ret == nvml.SUCCESS && pending == nvml.FEATURE_ENABLED, ret
+		},
+	},
+	{
+		// Rows waiting to be remapped on the next reset (Ampere and later)
+		reason: "row_remap_pending",
+		check: func(device nvml.Device) (bool, nvml.Return) {
+			_, _, pending, _, ret := device.GetRemappedRows()
+			return ret == nvml.SUCCESS && pending, ret
+		},
+	},
+	{
+		// No spare rows were left to remap a failing one
+		reason: "row_remap_failure",
+		check: func(device nvml.Device) (bool, nvml.Return) {
+			_, _, _, failure, ret := device.GetRemappedRows()
+			return ret == nvml.SUCCESS && failure, ret
+		},
+	},
+}
+
+// enabledAttentionConditions is the subset of attentionConditions selected
+// by -attention-conditions.
+var enabledAttentionConditions []attentionCondition
+
+// parseAttentionConditions selects the conditions named in a comma-separated
+// list.
+func parseAttentionConditions(s string) ([]attentionCondition, error) {
+	var selected []attentionCondition
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range attentionConditions {
+			if c.reason == name {
+				selected = append(selected, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown condition %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// collectAttention evaluates the enabled conditions. Conditions the GPU
+// doesn't support are skipped; the collector is only reported as not
+// supported when none of them is.
+func collectAttention(device nvml.Device, labels []string) nvml.Return {
+	result := nvml.ERROR_NOT_SUPPORTED
+	for _, c := range enabledAttentionConditions {
+		holds, ret := c.check(device)
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return ret
+		}
+		value := 0.0
+		if holds {
+			value = 1
+		}
+		gpuNeedsAttention.WithLabelValues(labels[0], labels[1], c.reason).Set(value)
+		result = nvml.SUCCESS
+	}
+	return result
+}
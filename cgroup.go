@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// podUIDPattern matches the pod segment of a kubepods cgroup path. The
+// cgroupfs driver writes the UID with dashes (pod1b2c...-...), the systemd
+// driver with underscores (kubepods-burstable-pod1b2c..._....slice).
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// containerScopePrefixes are the prefixes container runtimes give the
+// container cgroup under the systemd driver.
+var containerScopePrefixes = []string{"cri-containerd-", "crio-", "docker-"}
+
+// parseKubepodsCgroup extracts the pod UID and container ID from a cgroup
+// path, for example
+//
+//	/kubepods/burstable/pod8d1b0b6e-2b7a-4f4c-9b8e-3c6f1f0e7a11/4f9c...
+//	/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice/cri-containerd-4f9c....scope
+func parseKubepodsCgroup(cgroupPath string) (podUID, containerID string, ok bool) {
+	if !strings.Contains(cgroupPath, "kubepods") {
+		return "", "", false
+	}
+	match := podUIDPattern.FindStringSubmatch(cgroupPath)
+	if match == nil {
+		return "", "", false
+	}
+	podUID = strings.ReplaceAll(match[1], "_", "-")
+
+	// The container is the segment following the pod one, if any
+	container := path.Base(cgroupPath)
+	if podUIDPattern.MatchString(container) {
+		return podUID, "", true
+	}
+	container = strings.TrimSuffix(container, ".scope")
+	for _, prefix := range containerScopePrefixes {
+		container = strings.TrimPrefix(container, prefix)
+	}
+	return podUID, container, true
+}
+
+// processPodCgroup returns the pod UID and container ID of a host process
+// from /proc/<pid>/cgroup. Both cgroup v1 (one line per hierarchy) and v2
+// (a single "0::" line) are handled; the first kubepods path found is used.
+// Processes outside of any pod return an empty UID.
+func processPodCgroup(pid uint32) (podUID, containerID string, err error) {
+	data, err := os.ReadFile(filepath.Join(*procRoot, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if podUID, containerID, ok := parseKubepodsCgroup(fields[2]); ok {
+			return podUID, containerID, nil
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testPodUID      = "8d1b0b6e-2b7a-4f4c-9b8e-3c6f1f0e7a11"
+	testContainerID = "4f9c0d2e6b1a7c3f5e8d9b0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e"
+)
+
+func TestParseKubepodsCgroup(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		wantUID       string
+		wantContainer string
+		wantOK        bool
+	}{
+		{
+			name:          "cgroupfs",
+			path:          "/kubepods/burstable/pod" + testPodUID + "/" + testContainerID,
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+			wantOK:        true,
+		},
+		{
+			name:          "cgroupfs guaranteed",
+			path:          "/kubepods/pod" + testPodUID + "/" + testContainerID,
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+			wantOK:        true,
+		},
+		{
+			name:          "systemd containerd",
+			path:          "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice/cri-containerd-" + testContainerID + ".scope",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+			wantOK:        true,
+		},
+		{
+			name:          "systemd crio",
+			path:          "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice/crio-" + testContainerID + ".scope",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+			wantOK:        true,
+		},
+		{
+			name:          "systemd docker",
+			path:          "/kubepods.slice/kubepods-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice/docker-" + testContainerID + ".scope",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+			wantOK:        true,
+		},
+		{
+			name:    "pod cgroup only",
+			path:    "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice",
+			wantUID: testPodUID,
+			wantOK:  true,
+		},
+		{
+			name: "not a pod",
+			path: "/system.slice/containerd.service",
+		},
+		{
+			name: "kubepods without pod",
+			path: "/kubepods.slice/kubepods-burstable.slice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, container, ok := parseKubepodsCgroup(tt.path)
+			if uid != tt.wantUID || container != tt.wantContainer || ok != tt.wantOK {
+				t.Errorf("parseKubepodsCgroup(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.path, uid, container, ok, tt.wantUID, tt.wantContainer, tt.wantOK)
+			}
+		})
+	}
+}
+
+// withProcRoot points -proc-root at a temporary directory for the test.
+func withProcRoot(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous := *procRoot
+	*procRoot = dir
+	t.Cleanup(func() { *procRoot = previous })
+	return dir
+}
+
+func writeProcFile(t *testing.T, root, pid, name, content string) {
+	t.Helper()
+	dir := filepath.Join(root, pid)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessPodCgroup(t *testing.T) {
+	systemdPath := "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod8d1b0b6e_2b7a_4f4c_9b8e_3c6f1f0e7a11.slice/cri-containerd-" + testContainerID + ".scope"
+	tests := []struct {
+		name          string
+		cgroup        string
+		wantUID       string
+		wantContainer string
+	}{
+		{
+			name:          "v2",
+			cgroup:        "0::" + systemdPath + "\n",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+		},
+		{
+			name: "v1",
+			cgroup: "12:cpuset:/kubepods/burstable/pod" + testPodUID + "/" + testContainerID + "\n" +
+				"11:memory:/kubepods/burstable/pod" + testPodUID + "/" + testContainerID + "\n" +
+				"1:name=systemd:/kubepods/burstable/pod" + testPodUID + "/" + testContainerID + "\n",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+		},
+		{
+			name: "v1 with non-pod hierarchies first",
+			cgroup: "13:rdma:/\n" +
+				"12:devices:" + systemdPath + "\n",
+			wantUID:       testPodUID,
+			wantContainer: testContainerID,
+		},
+		{
+			name:   "host process",
+			cgroup: "0::/system.slice/nvidia-persistenced.service\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := withProcRoot(t)
+			writeProcFile(t, root, "4242", "cgroup", tt.cgroup)
+
+			uid, container, err := processPodCgroup(4242)
+			if err != nil {
+				t.Fatalf("processPodCgroup: %v", err)
+			}
+			if uid != tt.wantUID || container != tt.wantContainer {
+				t.Errorf("processPodCgroup = %q, %q, want %q, %q", uid, container, tt.wantUID, tt.wantContainer)
+			}
+		})
+	}
+
+	withProcRoot(t)
+	if _, _, err := processPodCgroup(4242); err == nil {
+		t.Error("processPodCgroup of a missing process succeeded")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// cycleMu serializes collection cycles.
+var cycleMu sync.Mutex
+
+// nvmlSlots holds a slot for every GPU being collected, by the collection
+// loop or the slow collectors, bounding them to -nvml-concurrency together.
+var nvmlSlots chan struct{}
+
+// runCycle runs one collection cycle. A panic in the cycle is logged and
+// counted instead of crashing the exporter, so one bad cycle doesn't put the
+// DaemonSet pod into a crash loop.
+func runCycle(lister podLister, gpuResources, execArgs []string) (success bool) {
+	// Cycles triggered through /collect wait for the running one
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+	heartbeat()
+
+	// Deferred first so it runs after the recover and sees panics as failures
+	defer func() { recordCycle(success) }()
+	defer recoverCycle("collection")
+
+	if err := collect(lister, gpuResources, execArgs); err != nil {
+		log.Printf("Collection cycle failed: %v", err)
+		return false
+	}
+	return true
+}
+
+// recoverCycle recovers from a panic in a collection cycle, logging the
+// stack trace and counting it.
+func recoverCycle(name string) {
+	if r := recover(); r != nil {
+		exporterPanics.Inc()
+		log.Printf("Recovered from panic in %s cycle: %v\n%s", name, r, debug.Stack())
+	}
+}
+
+// gatherPods lists the pods and indexes the GPU pods with the PIDs of their
+// containers.
+func gatherPods(lister podLister, gpuResources, execArgs []string) (*podIndex, []corev1.Pod, error) {
+	// List running containers
+	podList, err := lister.listPods()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("There are %d pods on this node", len(podList))
+
+	// Index the GPU pods and their PIDs
+	pods := newPodIndex()
+	excluded := excludedNamespaces()
+	for _, pod := range podList {
+		namespace := pod.Namespace
+		podName := pod.Name
+		if excluded[namespace] {
+			continue
+		}
+
+		// Skip pods that weren't granted a GPU, either through the device
+		// plugin or by setting NVIDIA_VISIBLE_DEVICES themselves
+		if !scansPod(&pod, gpuResources) {
+			continue
+		}
+		accessMode := gpuAccessMode(&pod)
+
+		log.Printf("Pod: %s/%s", namespace, podName)
+
+		pids := make(map[string][]string)
+		for _, container := range pod.Status.ContainerStatuses {
+			// The cgroup PID source reads the pod from each GPU process instead
+			if *pidSource == "cgroup" {
+				break
+			}
+
+			// Extract the container ID (trim off the "docker://" or similar prefix)
+			containerID := trimContainerID(container.ContainerID)
+
+			// Use "kubectl exec" to run the PID listing command inside the container
+			args := append([]string{"exec", "-n", namespace, podName, "-c", container.Name, "--"}, execArgs...)
+			cmd := exec.Command("kubectl", args...)
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				log.Printf("Failed to get PIDs for container %s in pod %s/%s: %v", containerID, namespace, podName, err)
+				continue
+			}
+
+			log.Printf("PIDs in container %s:\n%s", containerID, output)
+			pids[container.Name] = parsePIDs(output)
+		}
+
+		pods.add(&gpuPod{pod: &pod, accessMode: accessMode, pids: pids})
+	}
+
+	return pods, podList, nil
+}
+
+// collect gathers the PIDs of the GPU pods and exports the metrics of every
+// GPU on the node. In -device-only mode pods are not listed and only device
+// metrics are exported.
+func collect(lister podLister, gpuResources, execArgs []string) error {
+	pods := newPodIndex()
+	var podList []corev1.Pod
+	if !*deviceOnly {
+		var err error
+		pods, podList, err = gatherPods(lister, gpuResources, execArgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Allocations come from the kubelet and don't depend on the GPU processes
+	var allocations []gpuAllocation
+	var allocated map[string]bool
+	if podResources != nil {
+		var err error
+		allocations, err = podResources.listGPUAllocations(gpuResources)
+		if err != nil {
+			log.Printf("Unable to get GPU allocations: %v", err)
+		} else {
+			accumulateNamespaceGPUSeconds(allocations)
+			allocated = allocatedDevices(allocations)
+			pods.addAllocations(allocations)
+		}
+	}
+
+	stats := &Stats{Time: time.Now()}
+	// Get device count
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to get device count: %v", nvml.ErrorString(ret))
+	}
+	observeDeviceCount(count)
+
+	// Processes come and go, so their series are rebuilt every cycle
+	if *emitAllProcesses {
+		gpuProcessMemory.Reset()
+	}
+
+	// Collect up to -nvml-concurrency GPUs at once
+	results := make([]gpuResult, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for di := 0; di < count; di++ {
+		wg.Add(1)
+		nvmlSlots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-nvmlSlots }()
+			// A panic outside the cycle goroutine can't be recovered by
+			// runCycle, so it fails the cycle from here
+			defer func() {
+				if r := recover(); r != nil {
+					exporterPanics.Inc()
+					log.Printf("Recovered from panic collecting GPU %d: %v\n%s", di, r, debug.Stack())
+					errs[di] = fmt.Errorf("panic collecting GPU %d: %v", di, r)
+					if *markStaleOnError {
+						markUnreachableStale(di)
+					}
+				}
+			}()
+			results[di], errs[di] = collectGPU(di, pods, allocated)
+		}()
+	}
+	wg.Wait()
+	// A failing GPU is left out of the cycle, which still exports the
+	// others but counts as failed
+	var collectErr error
+	for di, err := range errs {
+		if err != nil {
+			log.Printf("Unable to collect GPU %d: %v", di, err)
+			if collectErr == nil {
+				collectErr = err
+			}
+		}
+	}
+
+	// Stats of each container across all devices and processes
+	containers := make(map[containerKey]*PodStats)
+	// Total memory of each device handle by UUID
+	memoryTotals := make(map[string]uint64)
+	// Node GPU power, over the devices that report it
+	var powerMilliwatts, powerLimitMilliwatts uint32
+	powerReported := false
+	for di, r := range results {
+		if errs[di] != nil {
+			continue
+		}
+		stats.Devices = append(stats.Devices, r.devices...)
+		for _, d := range r.devices {
+			memoryTotals[d.UUID] = d.MemoryTotal
+		}
+		for c, container := range r.containers {
+			if merged, ok := containers[c]; ok {
+				merged.MemoryUsed += container.MemoryUsed
+				merged.Processes = append(merged.Processes, container.Processes...)
+				merged.Devices = append(merged.Devices, container.Devices...)
+			} else {
+				containers[c] = container
+			}
+		}
+		if r.powerReported {
+			powerMilliwatts += r.powerMilliwatts
+			powerLimitMilliwatts += r.powerLimitMilliwatts
+			powerReported = true
+		}
+	}
+
+	if powerReported {
+		nodeGpuPower.Set(float64(powerMilliwatts) / 1000)
+		nodeGpuPowerLimit.Set(float64(powerLimitMilliwatts) / 1000)
+	}
+
+	setPodMemoryLimits(allocations, memoryTotals)
+
+	gpuPods := make(map[string]bool)
+	for c, container := range containers {
+		stats.Pods = append(stats.Pods, *container)
+		gpuPods[c.pod] = true
+	}
+	exportStats(stats)
+	// Reconciliation needs both the allocations and the attributed processes
+	// of every GPU, or pods on a failed GPU would look unused
+	if allocated != nil && collectErr == nil {
+		reconcileAllocations(pods, allocations, stats.Pods)
+	}
+
+	for key := range gpuPods {
+		p := pods.pods[key]
+		observeFirstGPUUse(p.pod)
+		podGpuAccessMode.WithLabelValues(p.pod.Namespace, p.pod.Name, p.accessMode).Set(1)
+	}
+	pruneFirstGPUUse(podList)
+	pruneTerminatedPods(pods)
+
+	return collectErr
+}
+
+// gpuResult holds what collecting one physical GPU contributes to the
+// node-wide stats of a cycle.
+type gpuResult struct {
+	// Stats of the GPU, or of each of its MIG instances
+	devices []DeviceStats
+	// Stats of each container on the GPU
+	containers           map[containerKey]*PodStats
+	powerMilliwatts      uint32
+	powerLimitMilliwatts uint32
+	powerReported        bool
+}
+
+// collectGPU runs the collectors of the physical GPU at index di and
+// collects the memory and processes of its device handles. GPUs are
+// collected concurrently, so it only touches state of its own GPU.
+func collectGPU(di int, pods *podIndex, allocated map[string]bool) (gpuResult, error) {
+	r := gpuResult{containers: make(map[containerKey]*PodStats)}
+	device, ret := nvml.DeviceGetHandleByIndex(di)
+	if ret != nvml.SUCCESS {
+		observeDeviceLost(di, ret)
+		if *markStaleOnError {
+			markUnreachableStale(di)
+		}
+		return r, fmt.Errorf("unable to get device at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	uuid, ret := device.GetUUID()
+	observeDeviceLost(di, ret)
+	if ret != nvml.SUCCESS {
+		if *markStaleOnError {
+			markUnreachableStale(di)
+		}
+		return r, fmt.Errorf("unable to get device UUID at index %d: %v", di, nvml.ErrorString(ret))
+	}
+	runDeviceCollectors(di, device, uuid, false)
+
+	// Idle time is only known when the allocations could be listed
+	if allocated != nil {
+		updateAllocatedIdle(di, device, uuid, allocated[uuid])
+	}
+
+	if power, ret := device.GetPowerUsage(); ret == nvml.SUCCESS {
+		r.powerMilliwatts = power
+		r.powerReported = true
+		if limit, ret := device.GetEnforcedPowerLimit(); ret == nvml.SUCCESS {
+			r.powerLimitMilliwatts = limit
+		}
+	}
+
+	// On MIG-enabled GPUs each instance is exported as its own device
+	handles := migDevices(device)
+	if len(handles) == 0 {
+		handles = []nvml.Device{device}
+	}
+	var usage deviceUsage
+	// Namespaces with processes on the physical GPU, across MIG instances
+	tenants := make(map[string]bool)
+	for _, handle := range handles {
+		d, err := collectDevice(di, handle, pods, r.containers)
+		if err != nil {
+			// The stats of the other instances are dropped along with it
+			if *markStaleOnError {
+				markGPUStale(uuid)
+			}
+			return r, err
+		}
+		r.devices = append(r.devices, d)
+		usage.add(d)
+		for _, namespace := range d.Namespaces {
+			tenants[namespace] = true
+		}
+	}
+	observeMigLayout(uuid, r.devices)
+	gpuIndex := strconv.Itoa(di)
+	if !*deviceOnly {
+		multiTenant := 0.0
+		if len(tenants) > 1 {
+			multiTenant = 1
+		}
+		gpuTenantNamespaces.WithLabelValues(gpuIndex, uuid).Set(float64(len(tenants)))
+		gpuMultiTenant.WithLabelValues(gpuIndex, uuid).Set(multiTenant)
+	}
+
+	if *migSummary {
+		gpuPhysicalMemoryUsed.WithLabelValues(gpuIndex, uuid).Set(float64(usage.memoryUsed))
+		gpuPhysicalMemoryTotal.WithLabelValues(gpuIndex, uuid).Set(float64(usage.memoryTotal))
+		gpuPhysicalProcesses.WithLabelValues(gpuIndex, uuid).Set(float64(usage.processes))
+	}
+	return r, nil
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gpuUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_utilization_percent",
+			Help: "Percent of time over the last sample period during which kernels were executing on the GPU",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuUtilizationRaw = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_utilization_raw_percent",
+			Help: "Unsmoothed GPU utilization, exported when -utilization-smoothing is set",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryActivity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_activity_percent",
+			Help: "Percent of time over the last sample period during which GPU memory was being read or written (memory bus busy, not memory full; see gpu_memory_used_percent)",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuTemperature = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_temperature_celsius",
+			Help: "GPU core temperature",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPowerUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_power_usage_watts",
+			Help: "GPU power draw",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuFanSpeed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_fan_speed_percent",
+			Help: "GPU fan speed as a percentage of its maximum",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuNvLinkActiveLinks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_nvlink_active_links",
+			Help: "Number of NVLink links in the active state",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuFabricState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_fabric_state",
+			Help: "NVSwitch fabric registration state of the GPU: 1 not started, 2 in progress, 3 completed",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuFabricStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_fabric_status",
+			Help: "NVML return code of the fabric registration once completed; 0 means success",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuClockThrottleSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gpu_clock_throttle_seconds_total",
+			Help: "Cumulative time the GPU clocks were throttled, by reason",
+		},
+		[]string{"gpu_index", "gpu_uuid", "reason"},
+	)
+	gpuEngineUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_engine_utilization_percent",
+			Help: "Utilization of the video encoder, video decoder, JPEG decoder and optical flow engines, by engine",
+		},
+		[]string{"gpu_index", "gpu_uuid", "engine"},
+	)
+	gpuClockOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_clock_offset_mhz",
+			Help: "Voltage-frequency curve offset applied to the graphics or memory clock, by domain",
+		},
+		[]string{"gpu_index", "gpu_uuid", "domain"},
+	)
+	gpuPcieLinkGenCurrent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_pcie_link_gen_current",
+			Help: "Current PCIe link generation",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPcieLinkGenMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_pcie_link_gen_max",
+			Help: "Maximum PCIe link generation supported by the GPU and the system",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPcieLinkWidthCurrent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_pcie_link_width_current",
+			Help: "Current PCIe link width in lanes",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPcieLinkWidthMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_pcie_link_width_max",
+			Help: "Maximum PCIe link width in lanes supported by the GPU and the system",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuEccAggregateErrors = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_ecc_aggregate_errors",
+			Help: "ECC errors over the lifetime of the GPU, by type",
+		},
+		[]string{"gpu_index", "gpu_uuid", "type"},
+	)
+	gpuEccEnabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_ecc_enabled",
+			Help: "Whether ECC is enabled (1) or disabled (0); state is current, or pending until the next reboot",
+		},
+		[]string{"gpu_index", "gpu_uuid", "state"},
+	)
+	gpuRetiredPages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_retired_pages",
+			Help: "Number of GPU memory pages retired, by cause",
+		},
+		[]string{"gpu_index", "gpu_uuid", "cause"},
+	)
+	gpuInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_info",
+			Help: "Board information of the GPU, always 1",
+		},
+		[]string{"gpu_index", "gpu_uuid", "model", "serial", "board_part_number", "vbios_version"},
+	)
+	gpuMinorNumber = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_minor_number",
+			Help: "Minor number of the GPU device file, i.e. N in /dev/nvidiaN",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryBandwidth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_bandwidth_bytes_per_second",
+			Help: "Achieved GPU memory bandwidth, estimated from the memory controller utilization and the theoretical peak",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryBandwidthPeak = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_bandwidth_peak_bytes_per_second",
+			Help: "Theoretical peak GPU memory bandwidth at the current memory clock",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+)
+
+// throttleReasons maps the clock throttle reason bits to label values.
+var throttleReasons = []struct {
+	mask   uint64
+	reason string
+}{
+	{nvml.ClocksThrottleReasonGpuIdle, "gpu_idle"},
+	{nvml.ClocksThrottleReasonApplicationsClocksSetting, "applications_clocks_setting"},
+	{nvml.ClocksThrottleReasonSwPowerCap, "sw_power_cap"},
+	{nvml.ClocksThrottleReasonHwSlowdown, "hw_slowdown"},
+	{nvml.ClocksThrottleReasonSyncBoost, "sync_boost"},
+	{nvml.ClocksThrottleReasonSwThermalSlowdown, "sw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwThermalSlowdown, "hw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{nvml.ClocksThrottleReasonDisplayClockSetting, "display_clock_setting"},
+}
+
+var (
+	throttleSamplesMu sync.Mutex
+	// Time of the last successful throttle sample, by GPU UUID
+	throttleSamples = make(map[string]time.Time)
+)
+
+// collectThrottle samples the current throttle reasons and credits the time
+// since the previous sample to each active reason. Samples are keyed by
+// UUID, but counters also carry gpu_index like every GPU metric, so a GPU
+// changing index starts new series. A gap longer than two collection
+// intervals (a failed sample, a device reset) is not credited.
+func collectThrottle(device nvml.Device, labels []string) nvml.Return {
+	reasons, ret := device.GetCurrentClocksThrottleReasons()
+
+	throttleSamplesMu.Lock()
+	defer throttleSamplesMu.Unlock()
+
+	uuid := labels[1]
+	if ret != nvml.SUCCESS {
+		delete(throttleSamples, uuid)
+		return ret
+	}
+
+	now := time.Now()
+	last, ok := throttleSamples[uuid]
+	throttleSamples[uuid] = now
+	for _, r := range throttleReasons {
+		counter := gpuClockThrottleSeconds.WithLabelValues(labels[0], uuid, r.reason)
+		if !ok || reasons&r.mask == 0 {
+			continue
+		}
+		if elapsed := now.Sub(last); elapsed <= 2*(*collectionInterval) {
+			counter.Add(elapsed.Seconds())
+		}
+	}
+	return nvml.SUCCESS
+}
+
+func enabledValue(state nvml.EnableState) float64 {
+	if state == nvml.FEATURE_ENABLED {
+		return 1
+	}
+	return 0
+}
+
+var (
+	utilizationEMAMu sync.Mutex
+	// Smoothed utilization, by GPU UUID
+	utilizationEMA = make(map[string]float64)
+)
+
+// collectUtilization exports the GPU and memory activity utilization. With
+// -utilization-smoothing the exported GPU utilization is an exponential
+// moving average across cycles and the instantaneous value is exported as
+// gpu_utilization_raw_percent.
+func collectUtilization(device nvml.Device, labels []string) nvml.Return {
+	utilization, ret := device.GetUtilizationRates()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	gpuMemoryActivity.WithLabelValues(labels...).Set(roundPercent(float64(utilization.Memory)))
+	value := float64(utilization.Gpu)
+
+	if *utilizationSmoothing > 0 {
+		gpuUtilizationRaw.WithLabelValues(labels...).Set(roundPercent(value))
+
+		utilizationEMAMu.Lock()
+		if previous, ok := utilizationEMA[labels[1]]; ok {
+			value = *utilizationSmoothing*value + (1-*utilizationSmoothing)*previous
+		}
+		utilizationEMA[labels[1]] = value
+		utilizationEMAMu.Unlock()
+	}
+	gpuUtilization.WithLabelValues(labels...).Set(roundPercent(value))
+	return nvml.SUCCESS
+}
+
+// collectMemoryBandwidth derives the memory bandwidth from the bus width and
+// the current memory clock. Both GDDR and HBM transfer twice per clock as
+// reported by NVML, so the peak is clock × 2 × bus width.
+func collectMemoryBandwidth(device nvml.Device, labels []string) nvml.Return {
+	busWidth, ret := device.GetMemoryBusWidth()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	clockMHz, ret := device.GetClockInfo(nvml.CLOCK_MEM)
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	utilization, ret := device.GetUtilizationRates()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	if busWidth == 0 || clockMHz == 0 {
+		return nvml.ERROR_NOT_SUPPORTED
+	}
+
+	peak := float64(clockMHz) * 1e6 * 2 * float64(busWidth) / 8
+	gpuMemoryBandwidthPeak.WithLabelValues(labels...).Set(peak)
+	gpuMemoryBandwidth.WithLabelValues(labels...).Set(peak * float64(utilization.Memory) / 100)
+	return nvml.SUCCESS
+}
+
+// collectPcieLink exports the negotiated and maximum PCIe link so degraded
+// links (fewer lanes or a lower generation than possible) stand out. The
+// current generation may drop while the GPU is idle to save power.
+func collectPcieLink(device nvml.Device, labels []string) nvml.Return {
+	genCurrent, ret := device.GetCurrPcieLinkGeneration()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	genMax, ret := device.GetMaxPcieLinkGeneration()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	widthCurrent, ret := device.GetCurrPcieLinkWidth()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	widthMax, ret := device.GetMaxPcieLinkWidth()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	gpuPcieLinkGenCurrent.WithLabelValues(labels...).Set(float64(genCurrent))
+	gpuPcieLinkGenMax.WithLabelValues(labels...).Set(float64(genMax))
+	gpuPcieLinkWidthCurrent.WithLabelValues(labels...).Set(float64(widthCurrent))
+	gpuPcieLinkWidthMax.WithLabelValues(labels...).Set(float64(widthMax))
+	return nvml.SUCCESS
+}
+
+// collectClockOffsets exports the graphics and memory clock offsets set for
+// custom clock profiles. A domain the device can't report is skipped; the
+// collector is only unsupported when neither can be read.
+func collectClockOffsets(device nvml.Device, labels []string) nvml.Return {
+	domains := []struct {
+		name   string
+		offset func() (int, nvml.Return)
+	}{
+		{"graphics", device.GetGpcClkVfOffset},
+		{"memory", device.GetMemClkVfOffset},
+	}
+	result := nvml.ERROR_NOT_SUPPORTED
+	for _, d := range domains {
+		offset, ret := d.offset()
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return ret
+		}
+		gpuClockOffset.WithLabelValues(labels[0], labels[1], d.name).Set(float64(offset))
+		result = nvml.SUCCESS
+	}
+	return result
+}
+
+// engineCollector exports the utilization of one media or CV engine. Each
+// engine is a collector of its own so the ones a device lacks are disabled
+// individually.
+func engineCollector(engine string, utilization func(device nvml.Device) (uint32, uint32, nvml.Return)) *deviceCollector {
+	return &deviceCollector{
+		name:        engine,
+		gauges:      []*prometheus.GaugeVec{gpuEngineUtilization},
+		staleLabels: prometheus.Labels{"engine": engine},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			percent, _, ret := utilization(device)
+			if ret == nvml.SUCCESS {
+				gpuEngineUtilization.WithLabelValues(labels[0], labels[1], engine).Set(roundPercent(float64(percent)))
+			}
+			return ret
+		},
+	}
+}
+
+// deviceCollector exports one group of device metrics that not every GPU
+// supports.
+type deviceCollector struct {
+	name string
+	// slow collectors query rarely changing, costly metrics and only run
+	// every -slow-interval
+	slow bool
+	// unsupportedModels lists model names known not to support the
+	// collector, so it is never attempted on them. They match GetName() as
+	// whole model numbers: "NVIDIA A10" matches "NVIDIA A10G" but not
+	// "NVIDIA A100"
+	unsupportedModels []string
+	collect           func(device nvml.Device, labels []string) nvml.Return
+	// gauges the collector sets, marked stale with -mark-stale-on-error
+	// when it fails; staleLabels restricts them to its own series
+	gauges      []*prometheus.GaugeVec
+	staleLabels prometheus.Labels
+}
+
+var deviceCollectors = []*deviceCollector{
+	{
+		name:    "utilization",
+		gauges:  []*prometheus.GaugeVec{gpuUtilization, gpuUtilizationRaw, gpuMemoryActivity},
+		collect: collectUtilization,
+	},
+	{
+		name:   "temperature",
+		gauges: []*prometheus.GaugeVec{gpuTemperature},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			temperature, ret := device.GetTemperature(nvml.TEMPERATURE_GPU)
+			if ret == nvml.SUCCESS {
+				gpuTemperature.WithLabelValues(labels...).Set(float64(temperature))
+			}
+			return ret
+		},
+	},
+	{
+		name:   "power",
+		gauges: []*prometheus.GaugeVec{gpuPowerUsage},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			milliwatts, ret := device.GetPowerUsage()
+			if ret == nvml.SUCCESS {
+				gpuPowerUsage.WithLabelValues(labels...).Set(float64(milliwatts) / 1000)
+			}
+			return ret
+		},
+	},
+	{
+		name:   "fan",
+		gauges: []*prometheus.GaugeVec{gpuFanSpeed},
+		// Passively cooled data-center cards have no fan of their own
+		unsupportedModels: []string{"Tesla", "NVIDIA A100", "NVIDIA A30", "NVIDIA A10", "NVIDIA A16", "NVIDIA A2",
+			"NVIDIA H100", "NVIDIA H200", "NVIDIA H800", "NVIDIA GH200", "NVIDIA B200", "NVIDIA L4"},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			speed, ret := device.GetFanSpeed()
+			if ret == nvml.SUCCESS {
+				gpuFanSpeed.WithLabelValues(labels...).Set(roundPercent(float64(speed)))
+			}
+			return ret
+		},
+	},
+	{
+		name:              "nvlink",
+		gauges:            []*prometheus.GaugeVec{gpuNvLinkActiveLinks},
+		unsupportedModels: []string{"GeForce", "Tesla T4", "NVIDIA L4", "NVIDIA A10", "NVIDIA A16", "NVIDIA A2"},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			active := 0
+			for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+				state, ret := device.GetNvLinkState(link)
+				if ret != nvml.SUCCESS {
+					if link == 0 {
+						return ret
+					}
+					// Links past the last one the device has
+					break
+				}
+				if state == nvml.FEATURE_ENABLED {
+					active++
+				}
+			}
+			gpuNvLinkActiveLinks.WithLabelValues(labels...).Set(float64(active))
+			return nvml.SUCCESS
+		},
+	},
+	{
+		name:   "fabric",
+		gauges: []*prometheus.GaugeVec{gpuFabricState, gpuFabricStatus},
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			info, ret := device.GetGpuFabricInfo()
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			// Systems without NVSwitch report the fabric as not supported
+			if info.State == nvml.GPU_FABRIC_STATE_NOT_SUPPORTED {
+				return nvml.ERROR_NOT_SUPPORTED
+			}
+			gpuFabricState.WithLabelValues(labels...).Set(float64(info.State))
+			gpuFabricStatus.WithLabelValues(labels...).Set(float64(info.Status))
+			return nvml.SUCCESS
+		},
+	},
+	{
+		name:    "memory_bandwidth",
+		gauges:  []*prometheus.GaugeVec{gpuMemoryBandwidth, gpuMemoryBandwidthPeak},
+		collect: collectMemoryBandwidth,
+	},
+	{
+		name:    "pcie",
+		gauges:  []*prometheus.GaugeVec{gpuPcieLinkGenCurrent, gpuPcieLinkGenMax, gpuPcieLinkWidthCurrent, gpuPcieLinkWidthMax},
+		collect: collectPcieLink,
+	},
+	{
+		name:    "throttle",
+		collect: collectThrottle,
+	},
+	{
+		name:    "sm_partition",
+		gauges:  []*prometheus.GaugeVec{gpuSMPartitionUtilization},
+		collect: collectSMPartitions,
+	},
+	engineCollector("encoder", nvml.Device.GetEncoderUtilization),
+	engineCollector("decoder", nvml.Device.GetDecoderUtilization),
+	engineCollector("jpeg", nvml.Device.GetJpgUtilization),
+	engineCollector("ofa", nvml.Device.GetOfaUtilization),
+	{
+		name:   "ecc_errors",
+		gauges: []*prometheus.GaugeVec{gpuEccAggregateErrors},
+		slow:   true,
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			corrected, ret := device.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.AGGREGATE_ECC)
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			uncorrected, ret := device.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.AGGREGATE_ECC)
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			gpuEccAggregateErrors.WithLabelValues(labels[0], labels[1], "corrected").Set(float64(corrected))
+			gpuEccAggregateErrors.WithLabelValues(labels[0], labels[1], "uncorrected").Set(float64(uncorrected))
+			return nvml.SUCCESS
+		},
+	},
+	{
+		name:   "ecc_mode",
+		gauges: []*prometheus.GaugeVec{gpuEccEnabled},
+		slow:   true,
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			current, pending, ret := device.GetEccMode()
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			gpuEccEnabled.WithLabelValues(labels[0], labels[1], "current").Set(enabledValue(current))
+			gpuEccEnabled.WithLabelValues(labels[0], labels[1], "pending").Set(enabledValue(pending))
+			return nvml.SUCCESS
+		},
+	},
+	{
+		name:   "retired_pages",
+		gauges: []*prometheus.GaugeVec{gpuRetiredPages},
+		slow:   true,
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			singleBit, ret := device.GetRetiredPages(nvml.PAGE_RETIREMENT_CAUSE_MULTIPLE_SINGLE_BIT_ECC_ERRORS)
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			doubleBit, ret := device.GetRetiredPages(nvml.PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR)
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			gpuRetiredPages.WithLabelValues(labels[0], labels[1], "multiple_single_bit_ecc").Set(float64(len(singleBit)))
+			gpuRetiredPages.WithLabelValues(labels[0], labels[1], "double_bit_ecc").Set(float64(len(doubleBit)))
+			return nvml.SUCCESS
+		},
+	},
+	{
+		name:    "attention",
+		gauges:  []*prometheus.GaugeVec{gpuNeedsAttention},
+		slow:    true,
+		collect: collectAttention,
+	},
+	{
+		name:    "clock_offset",
+		gauges:  []*prometheus.GaugeVec{gpuClockOffset},
+		slow:    true,
+		collect: collectClockOffsets,
+	},
+	{
+		name: "board_info",
+		slow: true,
+		collect: func(device nvml.Device, labels []string) nvml.Return {
+			model, ret := device.GetName()
+			if ret != nvml.SUCCESS {
+				return ret
+			}
+			// Not every board reports these; leave them empty
+			serial, _ := device.GetSerial()
+			partNumber, _ := device.GetBoardPartNumber()
+			vbios, _ := device.GetVbiosVersion()
+			gpuInfo.WithLabelValues(labels[0], labels[1], model, serial, partNumber, vbios).Set(1)
+			if minor, ret := device.GetMinorNumber(); ret == nvml.SUCCESS {
+				gpuMinorNumber.WithLabelValues(labels[0], labels[1]).Set(float64(minor))
+			}
+			return nvml.SUCCESS
+		},
+	},
+}
+
+// deviceState holds what the exporter knows about a physical GPU across
+// cycles: its model and which collectors are active for it.
+type deviceState struct {
+	Index int    `json:"index"`
+	UUID  string `json:"uuid"`
+	Model string `json:"model"`
+	// Minor number of the device file (/dev/nvidiaN), -1 if unknown
+	MinorNumber int      `json:"minor_number"`
+	Collectors  []string `json:"collectors"`
+
+	active []*deviceCollector
+	// Collectors that already ran once on the device
+	probed map[string]bool
+}
+
+var (
+	devicesMu sync.Mutex
+	devices   = make(map[string]*deviceState)
+)
+
+// getDeviceState returns the cached state of a device, reading its model
+// and selecting the collectors that apply to it on first sight.
+func getDeviceState(di int, device nvml.Device, uuid string) *deviceState {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+
+	if state, ok := devices[uuid]; ok {
+		state.Index = di
+		return state
+	}
+
+	model, ret := device.GetName()
+	if ret != nvml.SUCCESS {
+		log.Printf("Unable to get device name at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	minor, ret := device.GetMinorNumber()
+	if ret != nvml.SUCCESS {
+		log.Printf("Unable to get device minor number at index %d: %v", di, nvml.ErrorString(ret))
+		minor = -1
+	}
+
+	state := &deviceState{Index: di, UUID: uuid, Model: model, MinorNumber: minor, probed: make(map[string]bool)}
+	for _, c := range deviceCollectors {
+		if model != "" && modelMatches(model, c.unsupportedModels) {
+			log.Printf("Disabling %s collector on device %s (%s)", c.name, uuid, model)
+			continue
+		}
+		state.active = append(state.active, c)
+	}
+	state.updateNames()
+	devices[uuid] = state
+	return state
+}
+
+// cachedUUID returns the UUID of the GPU last seen at index di.
+func cachedUUID(di int) (string, bool) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	for uuid, state := range devices {
+		if state.Index == di {
+			return uuid, true
+		}
+	}
+	return "", false
+}
+
+func modelMatches(model string, names []string) bool {
+	for _, name := range names {
+		for i := strings.Index(model, name); i >= 0; {
+			rest := model[i+len(name):]
+			// A digit continues the model number, e.g. A10 in A100
+			if rest == "" || rest[0] < '0' || rest[0] > '9' {
+				return true
+			}
+			next := strings.Index(rest, name)
+			if next < 0 {
+				break
+			}
+			i += len(name) + next
+		}
+	}
+	return false
+}
+
+func (s *deviceState) updateNames() {
+	s.Collectors = make([]string, 0, len(s.active))
+	for _, c := range s.active {
+		s.Collectors = append(s.Collectors, c.name)
+	}
+}
+
+// disable removes a collector from the active ones. The slice is rebuilt
+// rather than modified, as the other tier may be iterating over it.
+func (s *deviceState) disable(c *deviceCollector) {
+	active := make([]*deviceCollector, 0, len(s.active))
+	for _, a := range s.active {
+		if a != c {
+			active = append(active, a)
+		}
+	}
+	s.active = active
+	s.updateNames()
+}
+
+// runDeviceCollectors runs the active collectors of a physical GPU for one
+// tier. The first run of each collector doubles as a probe: collectors the
+// device reports as not supported are disabled instead of being retried
+// every cycle.
+func runDeviceCollectors(di int, device nvml.Device, uuid string, slow bool) {
+	state := getDeviceState(di, device, uuid)
+	labels := []string{strconv.Itoa(di), uuid}
+
+	devicesMu.Lock()
+	active := state.active
+	devicesMu.Unlock()
+
+	for _, c := range active {
+		if c.slow != slow {
+			continue
+		}
+		ret := c.collect(device, labels)
+
+		devicesMu.Lock()
+		probe := !state.probed[c.name]
+		state.probed[c.name] = true
+		if probe && ret == nvml.ERROR_NOT_SUPPORTED {
+			state.disable(c)
+		}
+		devicesMu.Unlock()
+
+		if probe && ret == nvml.ERROR_NOT_SUPPORTED {
+			log.Printf("Disabling %s collector on device %s: not supported", c.name, uuid)
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			log.Printf("Unable to collect %s metrics for device at index %d: %v", c.name, di, nvml.ErrorString(ret))
+			if *markStaleOnError {
+				markStale(c.gauges, uuid, c.staleLabels)
+			}
+		}
+	}
+}
+
+// devicesHandler serves the known devices and their active collectors.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	devicesMu.Lock()
+	list := make([]deviceState, 0, len(devices))
+	for _, state := range devices {
+		list = append(list, *state)
+	}
+	devicesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Printf("Failed to write /devices response: %v", err)
+	}
+}
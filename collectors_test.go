@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestModelMatches(t *testing.T) {
+	nvlinkUnsupported := []string{"GeForce", "Tesla T4", "NVIDIA L4", "NVIDIA A10", "NVIDIA A16", "NVIDIA A2"}
+	tests := []struct {
+		model string
+		want  bool
+	}{
+		{"NVIDIA A10", true},
+		{"NVIDIA A10G", true},
+		{"NVIDIA A100-SXM4-80GB", false},
+		{"NVIDIA A100 80GB PCIe", false},
+		{"NVIDIA L4", true},
+		{"NVIDIA L40S", false},
+		{"NVIDIA L40", false},
+		{"Tesla T4", true},
+		{"NVIDIA GeForce RTX 4090", true},
+		{"NVIDIA A2", true},
+		{"NVIDIA A30", false},
+		{"NVIDIA H100 80GB HBM3", false},
+	}
+	for _, tt := range tests {
+		if got := modelMatches(tt.model, nvlinkUnsupported); got != tt.want {
+			t.Errorf("modelMatches(%q) = %v, want %v", tt.model, got, tt.want)
+		}
+	}
+}
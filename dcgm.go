@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dcgmField re-exports a native device metric under the name of the closest
+// DCGM exporter field.
+type dcgmField struct {
+	name string
+	help string
+	// source is the native metric; series not matching the match labels
+	// (e.g. another ECC error type) are skipped
+	source *prometheus.GaugeVec
+	match  map[string]string
+	// scale converts the native unit to the DCGM one
+	scale float64
+}
+
+const mebibyte = 1 << 20
+
+var dcgmFields = []dcgmField{
+	{name: "DCGM_FI_DEV_GPU_UTIL", help: "GPU utilization (in %).", source: gpuUtilization, scale: 1},
+	{name: "DCGM_FI_DEV_MEM_COPY_UTIL", help: "Memory utilization (in %).", source: gpuMemoryActivity, scale: 1},
+	{name: "DCGM_FI_DEV_FB_USED", help: "Framebuffer memory used (in MiB).", source: gpuMemoryUsed, scale: 1.0 / mebibyte},
+	{name: "DCGM_FI_DEV_FB_TOTAL", help: "Framebuffer memory total (in MiB).", source: gpuMemoryTotal, scale: 1.0 / mebibyte},
+	{name: "DCGM_FI_DEV_GPU_TEMP", help: "GPU temperature (in C).", source: gpuTemperature, scale: 1},
+	{name: "DCGM_FI_DEV_POWER_USAGE", help: "Power draw (in W).", source: gpuPowerUsage, scale: 1},
+	{name: "DCGM_FI_DEV_FAN_SPEED", help: "Fan speed (in %).", source: gpuFanSpeed, scale: 1},
+	{name: "DCGM_FI_DEV_PCIE_LINK_GEN", help: "PCIe link generation.", source: gpuPcieLinkGenCurrent, scale: 1},
+	{name: "DCGM_FI_DEV_PCIE_LINK_WIDTH", help: "PCIe link width.", source: gpuPcieLinkWidthCurrent, scale: 1},
+	{name: "DCGM_FI_DEV_ENC_UTIL", help: "Encoder utilization (in %).", source: gpuEngineUtilization,
+		match: map[string]string{"engine": "encoder"}, scale: 1},
+	{name: "DCGM_FI_DEV_DEC_UTIL", help: "Decoder utilization (in %).", source: gpuEngineUtilization,
+		match: map[string]string{"engine": "decoder"}, scale: 1},
+	{name: "DCGM_FI_DEV_ECC_SBE_AGG_TOTAL", help: "Total aggregate single-bit persistent ECC errors.", source: gpuEccAggregateErrors,
+		match: map[string]string{"type": "corrected"}, scale: 1},
+	{name: "DCGM_FI_DEV_ECC_DBE_AGG_TOTAL", help: "Total aggregate double-bit persistent ECC errors.", source: gpuEccAggregateErrors,
+		match: map[string]string{"type": "uncorrected"}, scale: 1},
+	{name: "DCGM_FI_DEV_RETIRED_SBE", help: "Total number of retired pages due to single-bit errors.", source: gpuRetiredPages,
+		match: map[string]string{"cause": "multiple_single_bit_ecc"}, scale: 1},
+	{name: "DCGM_FI_DEV_RETIRED_DBE", help: "Total number of retired pages due to double-bit errors.", source: gpuRetiredPages,
+		match: map[string]string{"cause": "double_bit_ecc"}, scale: 1},
+}
+
+// dcgmLabels are the labels of the DCGM exporter device metrics.
+var dcgmLabels = []string{"gpu", "UUID", "device", "modelName", "Hostname"}
+
+// dcgmCollector exports the native device metrics again under the DCGM
+// exporter names and labels on every scrape, so DCGM dashboards work
+// unchanged.
+type dcgmCollector struct {
+	hostname string
+	descs    []*prometheus.Desc
+}
+
+func newDCGMCollector() *dcgmCollector {
+	hostname := os.Getenv("NODE_NAME")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	c := &dcgmCollector{hostname: hostname}
+	for _, f := range dcgmFields {
+		c.descs = append(c.descs, prometheus.NewDesc(f.name, f.help, dcgmLabels, nil))
+	}
+	return c
+}
+
+func (c *dcgmCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *dcgmCollector) Collect(ch chan<- prometheus.Metric) {
+	models := make(map[string]string)
+	minors := make(map[string]int)
+	devicesMu.Lock()
+	for uuid, state := range devices {
+		models[uuid] = state.Model
+		minors[uuid] = state.MinorNumber
+	}
+	devicesMu.Unlock()
+
+	for i, f := range dcgmFields {
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			f.source.Collect(metrics)
+			close(metrics)
+		}()
+		for m := range metrics {
+			var sample dto.Metric
+			if err := m.Write(&sample); err != nil {
+				continue
+			}
+			labels := make(map[string]string)
+			for _, pair := range sample.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if !labelsMatch(labels, f.match) {
+				continue
+			}
+			index, uuid := labels["gpu_index"], labels["gpu_uuid"]
+			// DCGM names the device after its device file, whose minor
+			// number can differ from the index
+			device := "nvidia" + index
+			if minor, ok := minors[uuid]; ok && minor >= 0 {
+				device = "nvidia" + strconv.Itoa(minor)
+			}
+			ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.GaugeValue, sample.GetGauge().GetValue()*f.scale,
+				index, uuid, device, models[uuid], c.hostname)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// deviceUsage is the memory and process usage of one device handle,
+// used to roll MIG instances up to their physical GPU.
+type deviceUsage struct {
+	memoryUsed  uint64
+	memoryTotal uint64
+	processes   int
+}
+
+func (u *deviceUsage) add(s DeviceStats) {
+	u.memoryUsed += s.MemoryUsed
+	u.memoryTotal += s.MemoryTotal
+	u.processes += s.Processes
+}
+
+// migDevices returns the MIG device handles of a physical device, or nil
+// when MIG is disabled or not supported.
+func migDevices(device nvml.Device) []nvml.Device {
+	current, _, ret := device.GetMigMode()
+	if ret != nvml.SUCCESS || current != nvml.DEVICE_MIG_ENABLE {
+		return nil
+	}
+
+	maxCount, ret := device.GetMaxMigDeviceCount()
+	if ret != nvml.SUCCESS {
+		log.Printf("Unable to get MIG device count: %v", nvml.ErrorString(ret))
+		return nil
+	}
+
+	var migs []nvml.Device
+	for i := 0; i < maxCount; i++ {
+		mig, ret := device.GetMigDeviceHandleByIndex(i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// Slot without a configured instance
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			log.Printf("Unable to get MIG device at index %d: %v", i, nvml.ErrorString(ret))
+			continue
+		}
+		migs = append(migs, mig)
+	}
+	return migs
+}
+
+// collectDevice collects the memory and process stats of a single device
+// handle, either a physical GPU or a MIG instance, and attributes its
+// processes to the containers of pods. di is the index of the physical GPU
+// the handle belongs to.
+func collectDevice(di int, device nvml.Device, pods *podIndex, containers map[containerKey]*PodStats) (DeviceStats, error) {
+	uuid, ret := device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return DeviceStats{}, fmt.Errorf("unable to get device UUID at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	memoryInfo, ret := device.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return DeviceStats{}, fmt.Errorf("unable to get device memory at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	// Get running processes on device
+	processInfos, ret := device.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		return DeviceStats{}, fmt.Errorf("unable to get process info for device at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	stats := DeviceStats{
+		Index:       di,
+		UUID:        uuid,
+		MemoryUsed:  memoryInfo.Used,
+		MemoryTotal: memoryInfo.Total,
+		Processes:   len(processInfos),
+	}
+	gpuIndex := strconv.Itoa(di)
+
+	// PIDs on this device of each pod, for splitting its utilization
+	podProcesses := make(map[string][]uint32)
+	// Live processes that couldn't be attributed
+	unattributed := make(map[uint32]bool)
+
+	// Iterate over running processes
+	for _, processInfo := range processInfos {
+		// Processes below -min-process-memory are attributed for the device
+		// totals but get no per-process or pod series
+		small := processInfo.UsedGpuMemory < minProcessMemoryBytes
+
+		if *emitAllProcesses && !small {
+			name, ret := nvml.SystemGetProcessName(int(processInfo.Pid))
+			if ret != nvml.SUCCESS {
+				name = ""
+			}
+			gpuProcessMemory.WithLabelValues(gpuIndex, uuid, strconv.Itoa(int(processInfo.Pid)), name).Set(float64(processInfo.UsedGpuMemory))
+		}
+
+		// GPU memory held by processes whose CUDA context outlived them
+		if !processExists(processInfo.Pid) {
+			log.Printf("GPU process %d on device %s is not present in %s", processInfo.Pid, uuid, *procRoot)
+			stats.ZombieMemory += processInfo.UsedGpuMemory
+			continue
+		}
+
+		if !small {
+			startTime, err := processStartTime(processInfo.Pid)
+			if err != nil {
+				log.Printf("Unable to get start time of GPU process %d: %v", processInfo.Pid, err)
+			} else if time.Since(startTime) > *longRunningThreshold {
+				stats.LongRunningProcesses++
+			}
+		}
+
+		// Find the container running the process
+		c, ok := pods.lookup(processInfo.Pid, uuid)
+		if !ok {
+			unattributed[processInfo.Pid] = true
+			if holdPending(uuid, processInfo.Pid) {
+				stats.PendingMemory += processInfo.UsedGpuMemory
+			}
+			continue
+		}
+		stats.AttributedMemory += processInfo.UsedGpuMemory
+
+		// Small processes still count as the container using the device,
+		// e.g. for reconciling its allocations
+		container, ok := containers[c]
+		if !ok {
+			p := pods.pods[c.pod]
+			container = &PodStats{
+				Namespace: p.pod.Namespace,
+				Pod:       p.pod.Name,
+				Container: c.container,
+				Labels:    containerLabels(p, c.container),
+			}
+			containers[c] = container
+		}
+		if !slices.Contains(container.Devices, uuid) {
+			container.Devices = append(container.Devices, uuid)
+		}
+		if small {
+			continue
+		}
+		container.MemoryUsed += processInfo.UsedGpuMemory
+		container.Processes = append(container.Processes, ProcessStats{
+			PID:           processInfo.Pid,
+			DeviceUUID:    uuid,
+			MemoryUsed:    processInfo.UsedGpuMemory,
+			MemoryPercent: (float64(processInfo.UsedGpuMemory) / float64(memoryInfo.Total)) * 100,
+		})
+
+		if !slices.Contains(stats.Namespaces, container.Namespace) {
+			stats.Namespaces = append(stats.Namespaces, container.Namespace)
+		}
+		podProcesses[c.pod] = append(podProcesses[c.pod], processInfo.Pid)
+	}
+	prunePending(uuid, unattributed)
+	collectTimeSliceShares(gpuIndex, uuid, device, pods, podProcesses)
+
+	return stats, nil
+}
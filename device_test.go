@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock"
+)
+
+const testGPUUUID = "GPU-0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+
+// testDevice returns a device handle running processes, without
+// utilization sampling support.
+func testDevice(uuid string, processes []nvml.ProcessInfo) *mock.Device {
+	var used uint64
+	for _, p := range processes {
+		used += p.UsedGpuMemory
+	}
+	return &mock.Device{
+		GetUUIDFunc: func() (string, nvml.Return) { return uuid, nvml.SUCCESS },
+		GetMemoryInfoFunc: func() (nvml.Memory, nvml.Return) {
+			return nvml.Memory{Total: 80 << 30, Used: used}, nvml.SUCCESS
+		},
+		GetComputeRunningProcessesFunc: func() ([]nvml.ProcessInfo, nvml.Return) {
+			return processes, nvml.SUCCESS
+		},
+		GetUtilizationRatesFunc: func() (nvml.Utilization, nvml.Return) {
+			return nvml.Utilization{}, nvml.ERROR_NOT_SUPPORTED
+		},
+	}
+}
+
+// writeTestProcess fakes a host GPU process in the -proc-root: its PIDs in
+// each PID namespace and its container cgroup.
+func writeTestProcess(t *testing.T, root, pid, nspids, cgroup string) {
+	t.Helper()
+	writeProcFile(t, root, pid, "status", "Name:\tpython\nNSpid:\t"+nspids+"\n")
+	writeProcFile(t, root, pid, "cgroup", "0::"+cgroup+"\n")
+}
+
+func TestCollectDeviceSplitsContainersWithCollidingPIDs(t *testing.T) {
+	root := withProcRoot(t)
+	// Both containers run their GPU process as PID 1 of their own PID
+	// namespace
+	writeTestProcess(t, root, "4242", "4242\t1", "/kubepods/burstable/pod"+testPodUID+"/aaaa")
+	writeTestProcess(t, root, "4243", "4243\t1", "/kubepods/burstable/pod"+testPodUID+"/bbbb")
+
+	p := testGPUPod("ml", "trainer", testPodUID, map[string][]string{
+		"worker-a": {"1"},
+		"worker-b": {"1"},
+	})
+	p.pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "worker-a", ContainerID: "containerd://aaaa"},
+		{Name: "worker-b", ContainerID: "containerd://bbbb"},
+	}
+	idx := newPodIndex()
+	idx.add(p)
+
+	device := testDevice(testGPUUUID, []nvml.ProcessInfo{
+		{Pid: 4242, UsedGpuMemory: 10 << 30},
+		{Pid: 4243, UsedGpuMemory: 6 << 30},
+	})
+	containers := make(map[containerKey]*PodStats)
+	stats, err := collectDevice(0, device, idx, containers)
+	if err != nil {
+		t.Fatalf("collectDevice: %v", err)
+	}
+
+	if len(containers) != 2 {
+		t.Fatalf("got %d container stats, want 2: %v", len(containers), containers)
+	}
+	for container, want := range map[string]uint64{"worker-a": 10 << 30, "worker-b": 6 << 30} {
+		c, ok := containers[containerKey{pod: "ml/trainer", container: container}]
+		if !ok {
+			t.Errorf("no stats for container %s", container)
+			continue
+		}
+		if c.Container != container || c.MemoryUsed != want || len(c.Processes) != 1 {
+			t.Errorf("container %s: got %s with %d bytes in %d processes, want %d bytes in 1 process",
+				container, c.Container, c.MemoryUsed, len(c.Processes), want)
+		}
+	}
+	if stats.AttributedMemory != 16<<30 {
+		t.Errorf("attributed memory = %d, want %d", stats.AttributedMemory, uint64(16<<30))
+	}
+}
+
+func TestCollectDeviceAttributesSmallProcesses(t *testing.T) {
+	previous := minProcessMemoryBytes
+	minProcessMemoryBytes = 64 << 20
+	t.Cleanup(func() { minProcessMemoryBytes = previous })
+
+	const notebookUID = "11111111-2222-3333-4444-555555555555"
+	root := withProcRoot(t)
+	writeTestProcess(t, root, "4242", "4242\t7", "/kubepods/burstable/pod"+testPodUID+"/aaaa")
+	writeTestProcess(t, root, "4243", "4243\t8", "/kubepods/burstable/pod"+testPodUID+"/aaaa")
+	writeTestProcess(t, root, "4244", "4244\t9", "/kubepods/burstable/pod"+notebookUID+"/bbbb")
+
+	idx := newPodIndex()
+	idx.add(testGPUPod("ml", "trainer", testPodUID, map[string][]string{"train": {"7", "8"}}))
+	idx.add(testGPUPod("ml", "notebook", notebookUID, map[string][]string{"train": {"9"}}))
+
+	device := testDevice(testGPUUUID, []nvml.ProcessInfo{
+		{Pid: 4242, UsedGpuMemory: 8 << 30},
+		// Bare CUDA contexts below -min-process-memory
+		{Pid: 4243, UsedGpuMemory: 16 << 20},
+		{Pid: 4244, UsedGpuMemory: 16 << 20},
+	})
+	containers := make(map[containerKey]*PodStats)
+	stats, err := collectDevice(0, device, idx, containers)
+	if err != nil {
+		t.Fatalf("collectDevice: %v", err)
+	}
+
+	if stats.AttributedMemory != stats.MemoryUsed {
+		t.Errorf("attributed memory = %d, want all %d bytes used", stats.AttributedMemory, stats.MemoryUsed)
+	}
+	c := containers[containerKey{pod: "ml/trainer", container: "train"}]
+	if c == nil || c.MemoryUsed != 8<<30 || len(c.Processes) != 1 || c.Processes[0].PID != 4242 {
+		t.Errorf("container stats = %+v, want only process 4242 with %d bytes", c, uint64(8<<30))
+	}
+	// The notebook only holds a CUDA context, but still uses the device
+	notebook := containers[containerKey{pod: "ml/notebook", container: "train"}]
+	if notebook == nil || len(notebook.Processes) != 0 || !slices.Equal(notebook.Devices, []string{testGPUUUID}) {
+		t.Errorf("notebook container stats = %+v, want no processes on device %s", notebook, testGPUUUID)
+	}
+	if stats.Processes != 3 {
+		t.Errorf("processes = %d, want 3", stats.Processes)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stats are the device and pod stats collected in one cycle, fed to every
+// output of -outputs. Only the metrics set by prometheusExporter come from
+// them: the optional device collectors (utilization, temperature, ...), the
+// physical GPU, tenant, power and time-slice share metrics and those joined
+// with the PodResources allocations (GPU-seconds, memory limits, allocated
+// idle time, allocation mismatches) still export their Prometheus metrics
+// directly, so other outputs don't receive them.
+type Stats struct {
+	Time    time.Time     `json:"time"`
+	Devices []DeviceStats `json:"devices"`
+	Pods    []PodStats    `json:"pods,omitempty"`
+}
+
+// DeviceStats are the memory and process stats of one device handle, a
+// physical GPU or a MIG instance. Index is that of the physical GPU.
+type DeviceStats struct {
+	Index       int    `json:"index"`
+	UUID        string `json:"uuid"`
+	MemoryUsed  uint64 `json:"memory_used_bytes"`
+	MemoryTotal uint64 `json:"memory_total_bytes"`
+	// All compute processes, including those below -min-process-memory
+	Processes            int    `json:"processes"`
+	ZombieMemory         uint64 `json:"zombie_memory_bytes"`
+	LongRunningProcesses int    `json:"long_running_processes"`
+	AttributedMemory     uint64 `json:"attributed_memory_bytes"`
+	// Memory of processes not attributed yet, within -match-window
+	PendingMemory uint64 `json:"pending_memory_bytes"`
+	// Namespaces of the pods with processes on the device
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// PodStats are the stats of one container of a GPU pod across all devices.
+// Container is empty for processes only attributed to the pod.
+type PodStats struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// Values of the -pod-metric-labels labels
+	Labels     map[string]string `json:"labels,omitempty"`
+	MemoryUsed uint64            `json:"memory_used_bytes"`
+	// Processes of at least -min-process-memory
+	Processes []ProcessStats `json:"processes"`
+	// UUIDs of the devices the container has processes on, including those
+	// below -min-process-memory
+	Devices []string `json:"devices"`
+}
+
+// ProcessStats is a GPU process attributed to a container.
+type ProcessStats struct {
+	PID        uint32 `json:"pid"`
+	DeviceUUID string `json:"device_uuid"`
+	MemoryUsed uint64 `json:"memory_used_bytes"`
+	// Share of the memory of the device
+	MemoryPercent float64 `json:"memory_percent"`
+}
+
+// Exporter is an output the stats of every cycle are fed to.
+type Exporter interface {
+	Export(stats *Stats) error
+}
+
+// exporters are the outputs of -outputs.
+var exporters []Exporter
+
+// parseOutputs returns the exporters of a comma-separated list of outputs.
+func parseOutputs(s string, stdout io.Writer) ([]Exporter, error) {
+	var outputs []Exporter
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "prometheus":
+			outputs = append(outputs, &prometheusExporter{})
+		case "json":
+			outputs = append(outputs, jsonExporter{encoder: json.NewEncoder(stdout)})
+		default:
+			return nil, fmt.Errorf("unknown output %q", name)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no outputs given")
+	}
+	return outputs, nil
+}
+
+// exportStats feeds the stats of a cycle to every output.
+func exportStats(stats *Stats) {
+	sort.Slice(stats.Pods, func(i, j int) bool {
+		a, b := stats.Pods[i], stats.Pods[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Container < b.Container
+	})
+	for _, e := range exporters {
+		if err := e.Export(stats); err != nil {
+			log.Printf("Unable to export stats: %v", err)
+		}
+	}
+}
+
+// prometheusExporter sets the Prometheus metrics of the stats, which are
+// then scraped or pushed to -pushgateway-url.
+type prometheusExporter struct {
+	// Time of the previously exported stats, for integrating memory over
+	// the time actually elapsed between cycles
+	lastExport time.Time
+}
+
+func (e *prometheusExporter) Export(stats *Stats) error {
+	// Triggered and final cycles come early, so integrate over the time
+	// since the previous cycle. Like throttle time, the first cycle and a
+	// gap of more than two intervals (e.g. a paused schedule) aren't credited.
+	elapsed := stats.Time.Sub(e.lastExport)
+	integrate := !e.lastExport.IsZero() && elapsed <= 2*(*collectionInterval)
+	e.lastExport = stats.Time
+
+	for _, d := range stats.Devices {
+		gpuIndex := strconv.Itoa(d.Index)
+		gpuMemoryUsed.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.MemoryUsed))
+		gpuMemoryTotal.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.MemoryTotal))
+		if d.MemoryTotal > 0 {
+			gpuMemoryUsedPercent.WithLabelValues(gpuIndex, d.UUID).Set(roundPercent(float64(d.MemoryUsed) / float64(d.MemoryTotal) * 100))
+		}
+		gpuProcesses.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.Processes))
+		gpuZombieProcessMemory.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.ZombieMemory))
+		gpuLongRunningProcesses.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.LongRunningProcesses))
+		gpuMemoryAttributed.WithLabelValues(gpuIndex, d.UUID).Set(float64(d.AttributedMemory))
+		// Process memory is sampled separately from the device total and may
+		// briefly exceed it. Pending processes count as neither.
+		unattributed := float64(d.MemoryUsed) - float64(d.AttributedMemory) - float64(d.PendingMemory)
+		gpuMemoryUnattributed.WithLabelValues(gpuIndex, d.UUID).Set(math.Max(unattributed, 0))
+	}
+
+	podMemory := make(map[[2]string]uint64)
+	for _, p := range stats.Pods {
+		// Containers with only processes below -min-process-memory get no
+		// memory series
+		if len(p.Processes) == 0 {
+			continue
+		}
+		podMemory[[2]string{p.Namespace, p.Pod}] += p.MemoryUsed
+		extra := make([]string, len(extraPodLabels))
+		for i, name := range extraPodLabels {
+			extra[i] = p.Labels[name]
+		}
+
+		switch {
+		case *compactPodMetrics:
+			// Summed per pod below
+		case *memoryMetricMode == "gauge":
+			for _, process := range p.Processes {
+				labels := append([]string{strconv.Itoa(int(process.PID)), p.Pod, p.Container}, extra...)
+				podGpuMemoryUsed.WithLabelValues(labels...).Set(float64(process.MemoryUsed))
+				podGpuMemoryPercUsed.WithLabelValues(labels...).Set(roundPercent(process.MemoryPercent))
+			}
+		case *memoryMetricMode == "integral":
+			labels := append([]string{p.Namespace, p.Pod, p.Container}, extra...)
+			counter := podGpuMemoryBytesSeconds.WithLabelValues(labels...)
+			if integrate {
+				counter.Add(float64(p.MemoryUsed) * elapsed.Seconds())
+			}
+		}
+	}
+	// Observe each GPU-using pod once per cycle
+	for pod, used := range podMemory {
+		podGpuMemoryUsedHistogram.Observe(float64(used))
+		if *compactPodMetrics {
+			podGpuMemoryBytes.WithLabelValues(pod[0], pod[1]).Set(float64(used))
+		}
+	}
+	return nil
+}
+
+// jsonExporter writes the stats of every cycle as a JSON line, for
+// debugging.
+type jsonExporter struct {
+	encoder *json.Encoder
+}
+
+func (e jsonExporter) Export(stats *Stats) error {
+	return e.encoder.Encode(stats)
+}
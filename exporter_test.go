@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIntegralMemoryUsesElapsedTime(t *testing.T) {
+	previous := *memoryMetricMode
+	*memoryMetricMode = "integral"
+	t.Cleanup(func() { *memoryMetricMode = previous })
+	podGpuMemoryBytesSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "pod_gpu_memory_bytes_seconds_total"},
+		[]string{"namespace", "pod", "container"},
+	)
+	podGpuMemoryUsedHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "pod_gpu_memory_usage_bytes_histogram"})
+
+	e := &prometheusExporter{}
+	start := time.Now()
+	export := func(at time.Duration) float64 {
+		t.Helper()
+		stats := &Stats{
+			Time: start.Add(at),
+			Pods: []PodStats{{
+				Namespace: "ml", Pod: "trainer", Container: "train", MemoryUsed: 1 << 30,
+				Processes: []ProcessStats{{PID: 4242, DeviceUUID: testGPUUUID, MemoryUsed: 1 << 30}},
+				Devices:   []string{testGPUUUID},
+			}},
+		}
+		if err := e.Export(stats); err != nil {
+			t.Fatalf("Export: %v", err)
+		}
+		return testutil.ToFloat64(podGpuMemoryBytesSeconds.WithLabelValues("ml", "trainer", "train"))
+	}
+
+	gib := float64(1 << 30)
+	// The first cycle has no previous one to integrate from
+	if got := export(0); got != 0 {
+		t.Errorf("after the first cycle: %v, want 0", got)
+	}
+	// A triggered cycle 5s later only adds 5s
+	if got := export(5 * time.Second); got != 5*gib {
+		t.Errorf("after a triggered cycle: %v, want %v", got, 5*gib)
+	}
+	if got := export(5*time.Second + *collectionInterval); got != (5+collectionInterval.Seconds())*gib {
+		t.Errorf("after a regular cycle: %v, want %v", got, (5+collectionInterval.Seconds())*gib)
+	}
+	// A gap of more than two intervals isn't credited
+	if got := export(time.Hour); got != (5+collectionInterval.Seconds())*gib {
+		t.Errorf("after a gap: %v, want %v", got, (5+collectionInterval.Seconds())*gib)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gpuAllocatedIdleSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gpu_allocated_idle_seconds",
+		Help: "How long the GPU has continuously been allocated to a pod with utilization below -idle-utilization-threshold",
+	},
+	[]string{"gpu_index", "gpu_uuid"},
+)
+
+var (
+	idleSinceMu sync.Mutex
+	// When each allocated GPU became idle, by UUID
+	idleSince = make(map[string]time.Time)
+)
+
+// allocatedDevices returns the set of UUIDs of the GPUs and MIG instances
+// allocated to pods, keyed like the UUIDs NVML reports.
+func allocatedDevices(allocations []gpuAllocation) map[string]bool {
+	allocated := make(map[string]bool)
+	for _, a := range allocations {
+		for _, id := range a.deviceIDs {
+			allocated[id] = true
+		}
+	}
+	return allocated
+}
+
+// updateAllocatedIdle tracks for how long the GPU has been allocated but
+// idle. The timer restarts whenever the GPU is unallocated or its
+// utilization rises to the threshold. GPUs in MIG mode don't report
+// utilization and aren't tracked.
+func updateAllocatedIdle(di int, device nvml.Device, uuid string, allocated bool) {
+	gpuIndex := strconv.Itoa(di)
+	idleSinceMu.Lock()
+	defer idleSinceMu.Unlock()
+
+	utilization, ret := device.GetUtilizationRates()
+	if ret != nvml.SUCCESS {
+		delete(idleSince, uuid)
+		return
+	}
+
+	if !allocated || float64(utilization.Gpu) >= *idleUtilizationThreshold {
+		delete(idleSince, uuid)
+		gpuAllocatedIdleSeconds.WithLabelValues(gpuIndex, uuid).Set(0)
+		return
+	}
+	since, ok := idleSince[uuid]
+	if !ok {
+		since = time.Now()
+		idleSince[uuid] = since
+	}
+	gpuAllocatedIdleSeconds.WithLabelValues(gpuIndex, uuid).Set(time.Since(since).Seconds())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerLabelValues are the optional labels -pod-metric-labels adds to
+// the container metrics, computed from the container status.
+var containerLabelValues = map[string]func(status *corev1.ContainerStatus) string{
+	"image": func(status *corev1.ContainerStatus) string { return sanitizeImage(status.Image) },
+}
+
+// extraPodLabels is -pod-metric-labels parsed, in flag order.
+var extraPodLabels []string
+
+func parsePodMetricLabels(s string) ([]string, error) {
+	var labels []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := containerLabelValues[name]; !ok {
+			return nil, fmt.Errorf("unknown label %q", name)
+		}
+		labels = append(labels, name)
+	}
+	return labels, nil
+}
+
+// containerLabels returns the -pod-metric-labels labels of a container of
+// p. They are empty when the container isn't known.
+func containerLabels(p *gpuPod, container string) map[string]string {
+	if len(extraPodLabels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(extraPodLabels))
+	for _, name := range extraPodLabels {
+		labels[name] = ""
+	}
+	for i := range p.pod.Status.ContainerStatuses {
+		status := &p.pod.Status.ContainerStatuses[i]
+		if status.Name != container {
+			continue
+		}
+		for _, name := range extraPodLabels {
+			labels[name] = containerLabelValues[name](status)
+		}
+		break
+	}
+	return labels
+}
+
+// imageDigestLength is the number of hex digits image digests are truncated
+// to, as shown by container runtimes.
+const imageDigestLength = 12
+
+// sanitizeImage makes a container image reference a compact, valid label
+// value, truncating its digest: "repo@sha256:0123...def" becomes
+// "repo@sha256:0123456789ab".
+func sanitizeImage(image string) string {
+	image = strings.ToValidUTF8(strings.TrimSpace(image), "")
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		if algorithm, digest, ok := strings.Cut(image[i+1:], ":"); ok && len(digest) > imageDigestLength {
+			image = image[:i+1] + algorithm + ":" + digest[:imageDigestLength]
+		}
+	}
+	return image
+}
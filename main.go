@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
-	"os/exec"
+	"syscall"
+	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-    	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
@@ -19,140 +24,561 @@ import (
 )
 
 var (
+	gpuMemoryUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_used_bytes",
+			Help: "GPU memory used on the device or MIG instance",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_total_bytes",
+			Help: "Total GPU memory of the device or MIG instance",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryUsedPercent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_used_percent",
+			Help: "Percent of the memory of the device or MIG instance that is allocated (memory full, not memory bus busy; see gpu_memory_activity_percent)",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuProcesses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_processes",
+			Help: "Number of compute processes running on the device or MIG instance",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPhysicalMemoryUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_physical_memory_used_bytes",
+			Help: "GPU memory used on the physical GPU, summed across its MIG instances",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPhysicalMemoryTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_physical_memory_total_bytes",
+			Help: "Total GPU memory of the physical GPU, summed across its MIG instances",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuPhysicalProcesses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_physical_processes",
+			Help: "Number of compute processes on the physical GPU, summed across its MIG instances",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuLongRunningProcesses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_long_running_processes",
+			Help: "Number of GPU processes running longer than -long-running-threshold",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuProcessMemory = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_process_memory_bytes",
+			Help: "GPU memory used by each process reported by NVML, whether or not it was matched to a pod",
+		},
+		[]string{"gpu_index", "gpu_uuid", "pid", "process_name"},
+	)
+	gpuZombieProcessMemory = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_zombie_process_memory_bytes",
+			Help: "GPU memory held by processes reported by NVML but no longer present in /proc",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryAttributed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_attributed_bytes",
+			Help: "GPU memory used by processes attributed to a pod",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMemoryUnattributed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_memory_unattributed_bytes",
+			Help: "GPU memory used but not attributed to a pod: host processes, failed PID matches and driver reservations",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuTenantNamespaces = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_tenant_namespaces",
+			Help: "Number of distinct namespaces with processes on the GPU, across its MIG instances",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	gpuMultiTenant = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gpu_multi_tenant",
+			Help: "Whether processes of more than one namespace run on the GPU (1) or not (0)",
+		},
+		[]string{"gpu_index", "gpu_uuid"},
+	)
+	podGpuAccessMode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pod_gpu_access_mode",
+			Help: "How a Kubernetes Pod using the GPU got access to it: device-plugin allocation or env-injected NVIDIA_VISIBLE_DEVICES",
+		},
+		[]string{"namespace", "pod", "mode"},
+	)
+	podGpuFirstUseLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pod_gpu_first_use_latency_seconds",
+			Help:    "Time from a Kubernetes Pod starting to the first GPU process attributed to it, observed once per pod",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+	nodeGpuPower = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "node_gpu_power_watts",
+			Help: "Power draw summed over the GPUs of the node",
+		},
+	)
+	nodeGpuPowerLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "node_gpu_power_limit_watts",
+			Help: "Enforced power limit summed over the GPUs of the node that report their power draw",
+		},
+	)
+	podGpuMemoryBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pod_gpu_memory_bytes",
+			Help: "GPU memory used by Kubernetes Pod, summed across its processes and GPUs",
+		},
+		[]string{"namespace", "pod"},
+	)
+	exporterPanics = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gpu_exporter_panics_total",
+			Help: "Number of collection cycles aborted by a recovered panic",
+		},
+	)
+	// Buckets are configurable, so the histogram is created after flag parsing
+	podGpuMemoryUsedHistogram prometheus.Histogram
+	// Labels are configurable with -pod-metric-labels, so the container
+	// metrics are created after flag parsing
+	podGpuMemoryUsed         *prometheus.GaugeVec
+	podGpuMemoryPercUsed     *prometheus.GaugeVec
+	podGpuMemoryBytesSeconds *prometheus.CounterVec
+)
+
+// minProcessMemoryBytes is -min-process-memory parsed.
+var minProcessMemoryBytes uint64
+
+var (
+	collectionInterval = flag.Duration("interval", 30*time.Second, "Time between two collection cycles")
+	slowInterval       = flag.Duration("slow-interval", 5*time.Minute,
+		"Time between two collections of slow, rarely changing metrics (ECC counts, retired pages, board info)")
+	podMemoryBuckets = flag.String("pod-memory-buckets", "1Gi,2Gi,4Gi,8Gi,12Gi,16Gi,24Gi,32Gi,40Gi,48Gi,64Gi,80Gi",
+		"Comma-separated bucket boundaries (Kubernetes quantities) for pod_gpu_memory_usage_bytes_histogram")
+	emitAllProcesses = flag.Bool("emit-all-processes", false,
+		"Export gpu_process_memory_bytes for every NVML process regardless of pod match (high cardinality, for debugging)")
+	gpuResourceNames = flag.String("gpu-resource-names", "nvidia.com/gpu,nvidia.com/mig-*",
+		"Comma-separated GPU resource names; only pods requesting one of them are scanned. A trailing * matches a prefix. Empty scans all pods")
+	memoryMetricMode = flag.String("memory-metric-mode", "gauge",
+		"How pod GPU memory is exported: gauge (current usage) or integral (pod_gpu_memory_bytes_seconds_total counter)")
+	migSummary  = flag.Bool("mig-summary", false, "Also export physical GPU metrics aggregated across MIG instances")
+	execCommand = flag.String("exec-command", "ps -e -o pid=",
+		"Command run in each container to list its PIDs; the first field of each output line is parsed as a PID")
+	longRunningThreshold = flag.Duration("long-running-threshold", 24*time.Hour,
+		"GPU processes running longer than this are counted in gpu_long_running_processes")
+	percentPrecision = flag.Int("percent-precision", 2, "Decimals percentage metrics are rounded to; negative disables rounding")
+	procRoot         = flag.String("proc-root", "/proc", "Path to the host /proc, used to detect GPU processes that have exited")
+	pidSource        = flag.String("pid-source", "exec",
+		"How GPU processes are matched to pods: exec (list PIDs with -exec-command in each container) or cgroup (read the pod UID from /proc/<pid>/cgroup)")
+	successWindow           = flag.Int("success-window", 20, "Number of recent collection cycles gpu_exporter_collection_success_ratio is computed over")
+	attentionConditionNames = flag.String("attention-conditions", "uncorrected_ecc,retired_pages_pending,row_remap_pending,row_remap_failure",
+		"Comma-separated conditions that set gpu_needs_attention")
+	attentionEccThreshold = flag.Uint64("attention-ecc-threshold", 1,
+		"Volatile uncorrected ECC errors at which the uncorrected_ecc condition holds")
+	utilizationSmoothing = flag.Float64("utilization-smoothing", 0,
+		"Alpha of the exponential moving average applied to gpu_utilization_percent, between 0 and 1; 0 disables smoothing")
+	deviceOnly = flag.Bool("device-only", false,
+		"Only export device metrics: no Kubernetes client, pod listing or PID gathering, so it also runs on non-Kubernetes GPU nodes")
+	podResourcesSocket = flag.String("pod-resources-socket", "/var/lib/kubelet/pod-resources/kubelet.sock",
+		"Kubelet PodResources API socket used for device allocations; empty disables namespace_gpu_seconds_total")
+	terminatedPodGrace = flag.Duration("terminated-pod-grace", 0,
+		"Keep exporting the last-known series of a terminated GPU pod for this long before removing them; 0 never removes them")
+	podSource = flag.String("pod-source", "list",
+		"Where pods are read from: list (the API server every cycle) or informer (a watch-backed cache of the node pods)")
+	requireNodeName = flag.Bool("require-node-name", false,
+		"Refuse to start when NODE_NAME is not set instead of listing the pods of the whole cluster")
+	dcgmCompatNames = flag.Bool("dcgm-compat-names", false,
+		"Also export device metrics under the DCGM exporter names and labels (DCGM_FI_DEV_*)")
+	pushgatewayURL = flag.String("pushgateway-url", "",
+		"Pushgateway the metrics are pushed to after every collection cycle and on shutdown; empty disables pushing")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second,
+		"Upper bound on the final collection cycle and metrics push run on SIGTERM")
+	collectTokenFile = flag.String("collect-token-file", "",
+		"File holding the bearer token required by POST /collect; empty disables the endpoint")
+	minProcessMemory = flag.String("min-process-memory", "0",
+		"GPU processes using less memory than this quantity (e.g. 64Mi) are counted in gpu_processes but left out of per-process and pod metrics")
+	podMetricLabels = flag.String("pod-metric-labels", "",
+		"Comma-separated optional labels added to the container metrics: image. Each one adds cardinality")
+	markStaleOnError = flag.Bool("mark-stale-on-error", false,
+		"Set the series of a device to NaN when collecting them fails, instead of keeping their last value")
+	idleUtilizationThreshold = flag.Float64("idle-utilization-threshold", 5,
+		"GPU utilization percent below which an allocated GPU counts as idle in gpu_allocated_idle_seconds")
+	outputs = flag.String("outputs", "prometheus",
+		"Comma-separated outputs the device and pod stats of every cycle are fed to: prometheus (scraped, or pushed with -pushgateway-url) and json (a JSON line on stdout, for debugging, holding device and pod memory and processes only)")
+	excludeNamespaces = flag.String("exclude-namespaces", "kube-system,kube-public,kube-node-lease",
+		"Comma-separated namespaces whose pods are never scanned")
+	scanSystemNamespaces = flag.Bool("scan-system-namespaces", false,
+		"Scan kube-system, kube-public and kube-node-lease even when listed in -exclude-namespaces")
+	matchWindow = flag.Duration("match-window", 0,
+		"How long a new GPU process that matches no pod is retried before its memory counts as unattributed; 0 counts it right away")
+	nvmlConcurrency = flag.Int("nvml-concurrency", 1,
+		"Number of GPUs collected concurrently, by the collection loop and the slow collectors together; 1 collects them one after the other")
+	collectionScheduleSpec = flag.String("collection-schedule", "",
+		"Cron expression (minute hour day-of-month month day-of-week) of the minutes to collect in, e.g. \"* 8-18 * * 1-5\"; empty collects all the time")
+	compactPodMetrics = flag.Bool("compact-pod-metrics", false,
+		"Export pod GPU memory as a single pod_gpu_memory_bytes series per pod instead of per process and container")
+)
+
+// roundPercent rounds a percentage to -percent-precision decimals, so tiny
+// fluctuations don't produce a new sample value every scrape.
+func roundPercent(v float64) float64 {
+	if *percentPrecision < 0 {
+		return v
+	}
+	scale := math.Pow(10, float64(*percentPrecision))
+	return math.Round(v*scale) / scale
+}
+
+// parseMemoryBuckets parses a comma-separated list of Kubernetes quantities
+// (e.g. "512Mi,1Gi,80Gi") into sorted histogram bucket boundaries in bytes.
+func parseMemoryBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", field, err)
+		}
+		buckets = append(buckets, q.AsApproximateFloat64())
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
+
+func main() {
+	flag.Parse()
+
+	buckets, err := parseMemoryBuckets(*podMemoryBuckets)
+	if err != nil {
+		log.Fatalf("Invalid -pod-memory-buckets: %v", err)
+	}
+	podGpuMemoryUsedHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pod_gpu_memory_usage_bytes_histogram",
+			Help:    "Distribution of total GPU memory used per Kubernetes Pod, observed once per collection cycle",
+			Buckets: buckets,
+		},
+	)
+
+	extraPodLabels, err = parsePodMetricLabels(*podMetricLabels)
+	if err != nil {
+		log.Fatalf("Invalid -pod-metric-labels: %v", err)
+	}
+	if *compactPodMetrics && len(extraPodLabels) > 0 {
+		log.Printf("Ignoring -pod-metric-labels: its labels are per container and -compact-pod-metrics exports per pod")
+	}
 	podGpuMemoryUsed = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "pod_gpu_memory_usage",
 			Help: "GPU memory used by Kubernetes Pod",
 		},
-		[]string{"pid", "pod"},
+		append([]string{"pid", "pod", "container"}, extraPodLabels...),
 	)
 	podGpuMemoryPercUsed = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "docker_gpu_memory_perc_usage",
 			Help: "GPU memory in percentage used by pod",
 		},
-		[]string{"pid", "pod"},
+		append([]string{"pid", "pod", "container"}, extraPodLabels...),
+	)
+	podGpuMemoryBytesSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_gpu_memory_bytes_seconds_total",
+			Help: "GPU memory used by Kubernetes Pod integrated over time, for resource-seconds chargeback",
+		},
+		append([]string{"namespace", "pod", "container"}, extraPodLabels...),
 	)
-)
 
-func main() {
+	minMemory, err := resource.ParseQuantity(*minProcessMemory)
+	if err != nil || minMemory.Sign() < 0 {
+		log.Fatalf("Invalid -min-process-memory %q: must be a non-negative quantity such as 64Mi", *minProcessMemory)
+	}
+	minProcessMemoryBytes = uint64(minMemory.Value())
+
+	exporters, err = parseOutputs(*outputs, os.Stdout)
+	if err != nil {
+		log.Fatalf("Invalid -outputs: %v", err)
+	}
+
+	execArgs := execCommandArgs(*execCommand)
+	if len(execArgs) == 0 {
+		log.Fatalf("Invalid -exec-command: command is empty")
+	}
+
+	gpuResources := parseResourceNames(*gpuResourceNames)
+
+	enabledAttentionConditions, err = parseAttentionConditions(*attentionConditionNames)
+	if err != nil {
+		log.Fatalf("Invalid -attention-conditions: %v", err)
+	}
+
+	if *utilizationSmoothing < 0 || *utilizationSmoothing > 1 {
+		log.Fatalf("Invalid -utilization-smoothing %v: must be between 0 and 1", *utilizationSmoothing)
+	}
+
+	if *idleUtilizationThreshold < 0 || *idleUtilizationThreshold > 100 {
+		log.Fatalf("Invalid -idle-utilization-threshold %v: must be between 0 and 100", *idleUtilizationThreshold)
+	}
+
+	if *nvmlConcurrency < 1 {
+		log.Fatalf("Invalid -nvml-concurrency %d: must be at least 1", *nvmlConcurrency)
+	}
+	nvmlSlots = make(chan struct{}, *nvmlConcurrency)
+
+	if *successWindow < 1 {
+		log.Fatalf("Invalid -success-window %d: must be at least 1", *successWindow)
+	}
+	cycleResults = newCycleWindow(*successWindow)
+	if *collectionScheduleSpec != "" {
+		var err error
+		if collectionSchedule, err = parseSchedule(*collectionScheduleSpec); err != nil {
+			log.Fatalf("Invalid -collection-schedule %q: %v", *collectionScheduleSpec, err)
+		}
+	}
+
+	if *pidSource != "exec" && *pidSource != "cgroup" {
+		log.Fatalf("Invalid -pid-source %q: must be exec or cgroup", *pidSource)
+	}
+	if *podSource != "list" && *podSource != "informer" {
+		log.Fatalf("Invalid -pod-source %q: must be list or informer", *podSource)
+	}
+	if *memoryMetricMode != "gauge" && *memoryMetricMode != "integral" {
+		log.Fatalf("Invalid -memory-metric-mode %q: must be gauge or integral", *memoryMetricMode)
+	}
+	if *compactPodMetrics && *memoryMetricMode == "integral" {
+		log.Fatalf("-compact-pod-metrics replaces the gauge mode metrics and can't be combined with -memory-metric-mode=integral")
+	}
+
+	// The node name scopes pod listing to the node the exporter runs on
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" && !*deviceOnly {
+		if *requireNodeName {
+			log.Fatalf("NODE_NAME is not set: inject it from spec.nodeName with the downward API, or drop -require-node-name")
+		}
+		log.Printf("WARNING: NODE_NAME is not set, pods of every node in the cluster are listed and watched. " +
+			"Inject it from spec.nodeName with the downward API, or set -require-node-name to refuse to start without it")
+	}
+
 	// Register Prometheus metrics
 	reg := prometheus.NewRegistry()
-	reg.MustRegister(podGpuMemoryUsed)
-	reg.MustRegister(podGpuMemoryPercUsed)
+	reg.MustRegister(exporterPanics)
+	reg.MustRegister(collectionSuccessRatio)
+	reg.MustRegister(loopHeartbeat)
+	reg.MustRegister(handleRefreshes)
+	for _, cause := range handleRefreshCauses {
+		handleRefreshes.WithLabelValues(cause)
+	}
+	if collectionSchedule != nil {
+		reg.MustRegister(collectionWindowOpen)
+	}
+	if !*deviceOnly {
+		if *compactPodMetrics {
+			reg.MustRegister(podGpuMemoryBytes)
+		} else if *memoryMetricMode == "integral" {
+			reg.MustRegister(podGpuMemoryBytesSeconds)
+		} else {
+			reg.MustRegister(podGpuMemoryUsed)
+			reg.MustRegister(podGpuMemoryPercUsed)
+		}
+		reg.MustRegister(podGpuMemoryUsedHistogram)
+		reg.MustRegister(podGpuFirstUseLatency)
+		reg.MustRegister(podGpuAccessMode)
+		reg.MustRegister(podGpuTimeSliceShare)
+		reg.MustRegister(gpuMemoryAttributed)
+		reg.MustRegister(gpuMemoryUnattributed)
+		reg.MustRegister(gpuTenantNamespaces)
+		reg.MustRegister(gpuMultiTenant)
+		if *podResourcesSocket != "" {
+			reg.MustRegister(namespaceGpuSeconds)
+			reg.MustRegister(podGpuMemoryLimit)
+			reg.MustRegister(gpuAllocatedIdleSeconds)
+			reg.MustRegister(podGpuAllocationMismatch)
+		}
+		if *podSource == "informer" {
+			reg.MustRegister(informerSyncDuration)
+		}
+	}
+	reg.MustRegister(gpuMemoryUsed)
+	reg.MustRegister(gpuMemoryTotal)
+	reg.MustRegister(gpuMemoryUsedPercent)
+	reg.MustRegister(gpuProcesses)
+	reg.MustRegister(gpuZombieProcessMemory)
+	reg.MustRegister(gpuLongRunningProcesses)
+	reg.MustRegister(gpuUtilization)
+	reg.MustRegister(gpuMemoryActivity)
+	if *utilizationSmoothing > 0 {
+		reg.MustRegister(gpuUtilizationRaw)
+	}
+	reg.MustRegister(gpuTemperature)
+	reg.MustRegister(gpuPowerUsage)
+	reg.MustRegister(nodeGpuPower)
+	reg.MustRegister(nodeGpuPowerLimit)
+	reg.MustRegister(gpuFanSpeed)
+	reg.MustRegister(gpuNvLinkActiveLinks)
+	reg.MustRegister(gpuFabricState)
+	reg.MustRegister(gpuFabricStatus)
+	reg.MustRegister(gpuClockThrottleSeconds)
+	reg.MustRegister(gpuMemoryBandwidth)
+	reg.MustRegister(gpuMemoryBandwidthPeak)
+	reg.MustRegister(gpuEngineUtilization)
+	reg.MustRegister(gpuSMPartitionUtilization)
+	reg.MustRegister(gpuPcieLinkGenCurrent)
+	reg.MustRegister(gpuPcieLinkGenMax)
+	reg.MustRegister(gpuPcieLinkWidthCurrent)
+	reg.MustRegister(gpuPcieLinkWidthMax)
+	reg.MustRegister(gpuEccAggregateErrors)
+	reg.MustRegister(gpuEccEnabled)
+	reg.MustRegister(gpuRetiredPages)
+	reg.MustRegister(gpuNeedsAttention)
+	reg.MustRegister(gpuClockOffset)
+	reg.MustRegister(gpuInfo)
+	reg.MustRegister(gpuMinorNumber)
+	reg.MustRegister(slowCollectionTimestamp)
+	if *emitAllProcesses {
+		log.Printf("Exporting gpu_process_memory_bytes for every GPU process; this adds a series per process and is meant for debugging")
+		reg.MustRegister(gpuProcessMemory)
+	}
+	if *dcgmCompatNames {
+		reg.MustRegister(newDCGMCollector())
+	}
+	if *migSummary {
+		reg.MustRegister(gpuPhysicalMemoryUsed)
+		reg.MustRegister(gpuPhysicalMemoryTotal)
+		reg.MustRegister(gpuPhysicalProcesses)
+	}
 
 	// Initialize NVML
 	ret := nvml.Init()
 	if ret != nvml.SUCCESS {
 		log.Fatalf("Unable to initialize NVML: %v", nvml.ErrorString(ret))
 	}
+	// Cleared when the exporter stops while a collection cycle is still
+	// calling into NVML, which mustn't be shut down under it
+	shutdownNVML := true
 	defer func() {
+		if !shutdownNVML {
+			return
+		}
 		ret := nvml.Shutdown()
 		if ret != nvml.SUCCESS {
 			log.Fatalf("Unable to shutdown NVML: %v", nvml.ErrorString(ret))
 		}
 	}()
 
-	// Create a Kubernete client
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		panic(err.Error())
+	// Create a Kubernete client, unless only device metrics are exported
+	var clientset *kubernetes.Clientset
+	if !*deviceOnly {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			panic(err.Error())
+		}
+		// creates the clientset
+		clientset, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		if *podResourcesSocket != "" {
+			podResources, err = newPodResourcesClient(*podResourcesSocket)
+			if err != nil {
+				log.Fatalf("Unable to create PodResources client: %v", err)
+			}
+		}
 	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+
+	collectToken, err := readCollectToken()
 	if err != nil {
-		panic(err.Error())
+		log.Fatalf("Invalid -collect-token-file: %v", err)
 	}
 
 	// Start Prometheus metrics server
+	server := &http.Server{Addr: ":8000"}
 	go func() {
 		handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 		http.Handle("/metrics", handler)
-		log.Fatal(http.ListenAndServe(":8000", nil))
-	}()
-
-	for {
-		// List running containers
-		// get pods in all the namespaces by omitting namespace
-		pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			panic(err.Error())
+		http.HandleFunc("/devices", devicesHandler)
+		http.HandleFunc("/readyz", readyzHandler)
+		http.HandleFunc("/healthz", healthzHandler)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
-		fmt.Printf("There are %d pods in the cluster\n", len(pods.Items))
-
-		// Create a map to store PIDs with pod names as keys
-    		podPIDMap := make(map[string][]string)
-		for _, pod := range pods.Items {
-			namespace := pod.Namespace
-			podName := pod.Name
-
-			fmt.Printf("Pod: %s/%s\n", namespace, podName)
-
-			var pids []string
-			for _, container := range pod.Status.ContainerStatuses {
-			    	containerID := container.ContainerID
-
-			    	// Extract the container ID (trim off the "docker://" or similar prefix)
-			    	if len(containerID) > 0 {
-					containerID = containerID[strings.Index(containerID, "://")+3:]
-			   	}
+	}()
+	pusher := newPusher(reg, nodeName)
 
-			    	// Use "kubectl exec" to run "ps" command inside the container to list PIDs
-			    	cmd := exec.Command("kubectl", "exec", "-n", namespace, podName, "--", "ps", "-e", "-o", "pid=")
-			    	output, err := cmd.CombinedOutput()
-			    	if err != nil {
-					log.Printf("Failed to get PIDs for container %s in pod %s/%s: %v", containerID, namespace, podName, err)
-					continue
-			    	}
+	go runSlowCollector()
 
-			    	fmt.Printf("PIDs in container %s:\n%s\n", containerID, output)
-				pids = append(pids, strings.Fields(string(output))...)
+	// Pod metrics are only collected once the pod source is usable
+	var lister podLister
+	if clientset != nil {
+		lister = apiPodLister{clientset: clientset, nodeName: nodeName}
+		if *podSource == "informer" {
+			lister, err = startPodInformer(clientset, nodeName, make(chan struct{}))
+			if err != nil {
+				log.Fatalf("Unable to start pod informer: %v", err)
 			}
-
-			// Store the PIDs in the map with the pod name as the key
-        		podPIDMap[podName] = pids
-		}
-
-		// Get device count
-		count, ret := nvml.DeviceGetCount()
-		if ret != nvml.SUCCESS {
-			log.Fatalf("Unable to get device count: %v", nvml.ErrorString(ret))
 		}
+	}
+	ready.Store(true)
 
-		// Iterate over devices
-		for di := 0; di < count; di++ {
-			device, ret := nvml.DeviceGetHandleByIndex(di)
-			if ret != nvml.SUCCESS {
-				log.Fatalf("Unable to get device at index %d: %v", di, nvml.ErrorString(ret))
-			}
+	if collectToken != "" {
+		http.Handle("/collect", collectHandler(collectToken, func() bool {
+			return runCycle(lister, gpuResources, execArgs)
+		}))
+	}
 
-			memoryInfo, ret := device.GetMemoryInfo()
-			if ret != nvml.SUCCESS {
-				log.Fatalf("Unable to get device memory at index %d: %v", di, nvml.ErrorString(ret))
-			}
+	// Collect until SIGTERM, then drain before NVML is shut down
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
 
-			// Get running processes on device
-			processInfos, ret := device.GetComputeRunningProcesses()
-			if ret != nvml.SUCCESS {
-				log.Fatalf("Unable to get process info for device at index %d: %v", di, nvml.ErrorString(ret))
-			}
+	ticker := time.NewTicker(*collectionInterval)
+	defer ticker.Stop()
+	for {
+		if inCollectionWindow(time.Now()) {
+			runCycle(lister, gpuResources, execArgs)
+			ctx, cancel := context.WithTimeout(context.Background(), *collectionInterval)
+			pushMetrics(ctx, pusher)
+			cancel()
+		} else {
+			// The loop is idle rather than wedged, so /healthz stays healthy
+			heartbeat()
+		}
 
-			// Iterate over running processes
-			for _, processInfo := range processInfos {
-				// Iterate over pod PIDs
-				for podName, pids := range podPIDMap {
-					for pid := range pids {
-						if pid == int(processInfo.Pid) {
-							// Set Prometheus metrics
-							podGpuMemoryUsed.WithLabelValues(fmt.Sprintf("%d", pid), podName).Set(float64(processInfo.UsedGpuMemory))
-
-							percent := (float64(processInfo.UsedGpuMemory) / float64(memoryInfo.Total)) * 100
-							podGpuMemoryPercUsed.WithLabelValues(fmt.Sprintf("%d", pid), podName).Set(percent)
-						}
-					}
-				}
-			}
+		select {
+		case <-ticker.C:
+		case sig := <-signals:
+			log.Printf("Received %v, running a final collection cycle", sig)
+			shutdownNVML = drain(server, pusher, lister, gpuResources, execArgs)
+			return
 		}
-		time.Sleep(30 * time.Second)
 	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingKey identifies a GPU process on a device.
+type pendingKey struct {
+	uuid string
+	pid  uint32
+}
+
+var (
+	pendingMu sync.Mutex
+	// When each GPU process that couldn't be attributed was first seen
+	pendingProcesses = make(map[pendingKey]time.Time)
+)
+
+// holdPending reports whether an unattributed GPU process was first seen
+// less than -match-window ago. Processes that just started may show up in
+// NVML before they are listed in their container, so they are retried in
+// the following cycles instead of counting as unattributed right away.
+func holdPending(uuid string, pid uint32) bool {
+	if *matchWindow <= 0 {
+		return false
+	}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	key := pendingKey{uuid: uuid, pid: pid}
+	first, ok := pendingProcesses[key]
+	if !ok {
+		first = time.Now()
+		pendingProcesses[key] = first
+	}
+	return time.Since(first) < *matchWindow
+}
+
+// prunePending forgets the pending processes of the device that weren't
+// held in this cycle: they exited or were attributed. Processes past the
+// window stay so they aren't held again.
+func prunePending(uuid string, unattributed map[uint32]bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	for key := range pendingProcesses {
+		if key.uuid == uuid && !unattributed[key.pid] {
+			delete(pendingProcesses, key)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+func TestMatchWindowStartupRace(t *testing.T) {
+	previous := *matchWindow
+	*matchWindow = time.Minute
+	t.Cleanup(func() {
+		*matchWindow = previous
+		pendingProcesses = make(map[pendingKey]time.Time)
+	})
+	pendingProcesses = make(map[pendingKey]time.Time)
+
+	root := withProcRoot(t)
+	writeProcFile(t, root, "6001", "status", "Name:\tpython\nNSpid:\t6001\t7\n")
+	writeProcFile(t, root, "6002", "status", "Name:\tpython\nNSpid:\t6002\t9\n")
+	device := testDevice(testGPUUUID, []nvml.ProcessInfo{
+		{Pid: 6001, UsedGpuMemory: 4 << 30},
+		{Pid: 6002, UsedGpuMemory: 2 << 30},
+	})
+	cycle := func(pids []string) DeviceStats {
+		t.Helper()
+		idx := newPodIndex()
+		idx.add(testGPUPod("ml", "trainer", testPodUID, map[string][]string{"train": pids}))
+		stats, err := collectDevice(0, device, idx, make(map[containerKey]*PodStats))
+		if err != nil {
+			t.Fatalf("collectDevice: %v", err)
+		}
+		return stats
+	}
+	unattributed := func(s DeviceStats) uint64 {
+		return s.MemoryUsed - s.AttributedMemory - s.PendingMemory
+	}
+
+	// Cycle 1: the processes started before the PID listing shows them
+	stats := cycle([]string{"1"})
+	if stats.PendingMemory != 6<<30 || unattributed(stats) != 0 {
+		t.Errorf("cycle 1: pending %d, unattributed %d, want %d and 0", stats.PendingMemory, unattributed(stats), uint64(6<<30))
+	}
+
+	// Cycle 2: 6001 is listed now and no longer pending
+	stats = cycle([]string{"1", "7"})
+	if stats.AttributedMemory != 4<<30 || stats.PendingMemory != 2<<30 || unattributed(stats) != 0 {
+		t.Errorf("cycle 2: attributed %d, pending %d, unattributed %d, want %d, %d and 0",
+			stats.AttributedMemory, stats.PendingMemory, unattributed(stats), uint64(4<<30), uint64(2<<30))
+	}
+	if _, ok := pendingProcesses[pendingKey{uuid: testGPUUUID, pid: 6001}]; ok {
+		t.Error("cycle 2: attributed process 6001 is still pending")
+	}
+
+	// 6002 never shows up in a container and outlives the window
+	pendingProcesses[pendingKey{uuid: testGPUUUID, pid: 6002}] = time.Now().Add(-*matchWindow)
+	for i := 3; i <= 4; i++ {
+		stats = cycle([]string{"1", "7"})
+		if stats.PendingMemory != 0 || unattributed(stats) != 2<<30 {
+			t.Errorf("cycle %d: pending %d, unattributed %d, want 0 and %d", i, stats.PendingMemory, unattributed(stats), uint64(2<<30))
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var namespaceGpuSeconds = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "namespace_gpu_seconds_total",
+		Help: "GPUs allocated to the pods of the namespace integrated over time, for chargeback",
+	},
+	[]string{"namespace"},
+)
+
+// podResources is set unless -pod-resources-socket is empty or only device
+// metrics are exported.
+var podResources *podResourcesClient
+
+var podGpuMemoryLimit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pod_gpu_memory_limit_bytes",
+		Help: "GPU memory of the MIG instances and GPUs allocated to the pod, counting the whole memory of a time-sliced GPU once",
+	},
+	[]string{"namespace", "pod"},
+)
+
+var podGpuAllocationMismatch = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pod_gpu_allocation_mismatch",
+		Help: "Whether the pod runs processes on a GPU it wasn't allocated or uses fewer GPUs than allocated (1) or not (0)",
+	},
+	[]string{"namespace", "pod"},
+)
+
+// podResourcesTimeout bounds a single List call to the kubelet.
+const podResourcesTimeout = 10 * time.Second
+
+// gpuAllocation is a GPU resource the kubelet allocated to a container,
+// from the PodResources API.
+type gpuAllocation struct {
+	namespace string
+	pod       string
+	container string
+	resource  string
+	deviceIDs []string
+}
+
+// podResourcesClient lists device allocations from the kubelet PodResources
+// API on the node.
+type podResourcesClient struct {
+	conn   *grpc.ClientConn
+	client podresourcesv1.PodResourcesListerClient
+}
+
+func newPodResourcesClient(socket string) (*podResourcesClient, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &podResourcesClient{conn: conn, client: podresourcesv1.NewPodResourcesListerClient(conn)}, nil
+}
+
+// listGPUAllocations returns the allocations of resources matching one of
+// patterns, as accepted by -gpu-resource-names.
+func (c *podResourcesClient) listGPUAllocations(patterns []string) ([]gpuAllocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+
+	resp, err := c.client.List(ctx, &podresourcesv1.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pod resources: %v", err)
+	}
+
+	var allocations []gpuAllocation
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				if !resourceMatches(devices.GetResourceName(), patterns) || len(devices.GetDeviceIds()) == 0 {
+					continue
+				}
+				allocations = append(allocations, gpuAllocation{
+					namespace: pod.GetNamespace(),
+					pod:       pod.GetName(),
+					container: container.GetName(),
+					resource:  devices.GetResourceName(),
+					deviceIDs: deviceUUIDs(devices.GetDeviceIds()),
+				})
+			}
+		}
+	}
+	return allocations, nil
+}
+
+// lastAllocationListing is when the allocations were last listed
+// successfully.
+var lastAllocationListing time.Time
+
+// deviceUUIDs turns kubelet device IDs into the UUIDs NVML reports. The
+// NVIDIA device plugin names time-sliced replicas of a GPU <uuid>::<n>, and
+// several replicas of one GPU allocated to a container are the same device.
+func deviceUUIDs(ids []string) []string {
+	uuids := make([]string, 0, len(ids))
+	for _, id := range ids {
+		uuid, _, _ := strings.Cut(id, "::")
+		if !slices.Contains(uuids, uuid) {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids
+}
+
+// accumulateNamespaceGPUSeconds adds the GPUs allocated in each namespace
+// times the time since the previous successful listing to
+// namespace_gpu_seconds_total. Like throttle time, the first listing and a
+// gap of more than two intervals aren't credited.
+func accumulateNamespaceGPUSeconds(allocations []gpuAllocation) {
+	now := time.Now()
+	elapsed := now.Sub(lastAllocationListing)
+	integrate := !lastAllocationListing.IsZero() && elapsed <= 2*(*collectionInterval)
+	lastAllocationListing = now
+
+	gpus := make(map[string]int)
+	for _, a := range allocations {
+		gpus[a.namespace] += len(a.deviceIDs)
+	}
+	for namespace, count := range gpus {
+		counter := namespaceGpuSeconds.WithLabelValues(namespace)
+		if integrate {
+			counter.Add(float64(count) * elapsed.Seconds())
+		}
+	}
+}
+
+// setPodMemoryLimits exports the memory each pod was granted: the total
+// memory of the MIG instances (or whole GPUs) allocated to it, joined on
+// the UUIDs the device plugin uses as device IDs. memoryTotals holds the
+// total memory of every device handle by UUID. Time-slicing doesn't
+// partition memory, so a time-sliced GPU counts with all of its memory, once
+// per pod however many replicas of it the pod's containers hold.
+func setPodMemoryLimits(allocations []gpuAllocation, memoryTotals map[string]uint64) {
+	limits := make(map[[2]string]uint64)
+	counted := make(map[[3]string]bool)
+	for _, a := range allocations {
+		for _, id := range a.deviceIDs {
+			total, ok := memoryTotals[id]
+			if !ok || counted[[3]string{a.namespace, a.pod, id}] {
+				continue
+			}
+			counted[[3]string{a.namespace, a.pod, id}] = true
+			limits[[2]string{a.namespace, a.pod}] += total
+		}
+	}
+	for pod, limit := range limits {
+		podGpuMemoryLimit.WithLabelValues(pod[0], pod[1]).Set(float64(limit))
+	}
+}
+
+// reconcileAllocations compares the devices allocated to each scanned pod
+// with those its processes were found on. A pod is mismatched when it uses
+// a device it wasn't allocated, which bypasses the device plugin, or
+// doesn't use all the devices it was allocated.
+func reconcileAllocations(pods *podIndex, allocations []gpuAllocation, stats []PodStats) {
+	allocated := make(map[string]map[string]bool)
+	used := make(map[string]map[string]bool)
+	add := func(m map[string]map[string]bool, key, uuid string) {
+		if m[key] == nil {
+			m[key] = make(map[string]bool)
+		}
+		m[key][uuid] = true
+	}
+	for _, a := range allocations {
+		for _, id := range a.deviceIDs {
+			add(allocated, a.namespace+"/"+a.pod, id)
+		}
+	}
+	for _, p := range stats {
+		for _, uuid := range p.Devices {
+			add(used, p.Namespace+"/"+p.Pod, uuid)
+		}
+	}
+
+	for key, p := range pods.pods {
+		if allocated[key] == nil && used[key] == nil {
+			continue
+		}
+		mismatch := 0.0
+		for uuid := range used[key] {
+			if !allocated[key][uuid] {
+				mismatch = 1
+			}
+		}
+		for uuid := range allocated[key] {
+			if !used[key][uuid] {
+				mismatch = 1
+			}
+		}
+		podGpuAllocationMismatch.WithLabelValues(p.pod.Namespace, p.pod.Name).Set(mismatch)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNamespaceGPUSecondsUsesElapsedTime(t *testing.T) {
+	t.Cleanup(func() {
+		lastAllocationListing = time.Time{}
+		namespaceGpuSeconds.Reset()
+	})
+	allocations := []gpuAllocation{
+		{namespace: "ml", pod: "trainer", container: "train", resource: "nvidia.com/gpu", deviceIDs: []string{"GPU-a", "GPU-b"}},
+	}
+	value := func() float64 { return testutil.ToFloat64(namespaceGpuSeconds.WithLabelValues("ml")) }
+
+	// The first listing has no previous one to integrate from
+	accumulateNamespaceGPUSeconds(allocations)
+	if got := value(); got != 0 {
+		t.Errorf("after the first listing: %v, want 0", got)
+	}
+
+	// A triggered cycle 5s after the previous listing only adds 5s per GPU
+	lastAllocationListing = time.Now().Add(-5 * time.Second)
+	accumulateNamespaceGPUSeconds(allocations)
+	if got := value(); got < 10 || got > 10.5 {
+		t.Errorf("after a triggered cycle: %v, want about 10", got)
+	}
+
+	// A gap of more than two intervals isn't credited
+	before := value()
+	lastAllocationListing = time.Now().Add(-3 * (*collectionInterval))
+	accumulateNamespaceGPUSeconds(allocations)
+	if got := value(); got != before {
+		t.Errorf("after a gap: %v, want %v", got, before)
+	}
+}
+
+// fakePodResourcesLister answers List with a fixed response.
+type fakePodResourcesLister struct {
+	podresourcesv1.PodResourcesListerClient
+	resp *podresourcesv1.ListPodResourcesResponse
+}
+
+func (f fakePodResourcesLister) List(context.Context, *podresourcesv1.ListPodResourcesRequest, ...grpc.CallOption) (*podresourcesv1.ListPodResourcesResponse, error) {
+	return f.resp, nil
+}
+
+// testReplicaAllocations lists two pods sharing testGPUUUID through
+// time-sliced replicas, the first one holding two replicas.
+func testReplicaAllocations(t *testing.T) []gpuAllocation {
+	t.Helper()
+	pod := func(name string, ids ...string) *podresourcesv1.PodResources {
+		return &podresourcesv1.PodResources{
+			Name:      name,
+			Namespace: "ml",
+			Containers: []*podresourcesv1.ContainerResources{{
+				Name:    "train",
+				Devices: []*podresourcesv1.ContainerDevices{{ResourceName: "nvidia.com/gpu", DeviceIds: ids}},
+			}},
+		}
+	}
+	client := &podResourcesClient{client: fakePodResourcesLister{resp: &podresourcesv1.ListPodResourcesResponse{
+		PodResources: []*podresourcesv1.PodResources{
+			pod("trainer", testGPUUUID+"::0", testGPUUUID+"::3"),
+			pod("notebook", testGPUUUID+"::1"),
+		},
+	}}}
+	allocations, err := client.listGPUAllocations([]string{"nvidia.com/gpu"})
+	if err != nil {
+		t.Fatalf("listGPUAllocations: %v", err)
+	}
+	return allocations
+}
+
+func TestTimeSlicedReplicaAllocations(t *testing.T) {
+	t.Cleanup(podGpuAllocationMismatch.Reset)
+	allocations := testReplicaAllocations(t)
+	for _, a := range allocations {
+		if !slices.Equal(a.deviceIDs, []string{testGPUUUID}) {
+			t.Errorf("allocation of %s: device IDs %v, want [%s]", a.pod, a.deviceIDs, testGPUUUID)
+		}
+	}
+
+	idx := newPodIndex()
+	idx.add(testGPUPod("ml", "trainer", testPodUID, nil))
+	idx.add(testGPUPod("ml", "notebook", "11111111-2222-3333-4444-555555555555", nil))
+	idx.addAllocations(allocations)
+	if got := len(idx.byDevice[testGPUUUID]); got != 2 {
+		t.Errorf("containers allocated %s: %d, want 2", testGPUUUID, got)
+	}
+
+	stats := []PodStats{
+		{Namespace: "ml", Pod: "trainer", Container: "train", Processes: []ProcessStats{{PID: 4242, DeviceUUID: testGPUUUID}}, Devices: []string{testGPUUUID}},
+		{Namespace: "ml", Pod: "notebook", Container: "train", Processes: []ProcessStats{{PID: 4243, DeviceUUID: testGPUUUID}}, Devices: []string{testGPUUUID}},
+	}
+	reconcileAllocations(idx, allocations, stats)
+	for _, pod := range []string{"trainer", "notebook"} {
+		if got := testutil.ToFloat64(podGpuAllocationMismatch.WithLabelValues("ml", pod)); got != 0 {
+			t.Errorf("pod_gpu_allocation_mismatch of %s = %v, want 0", pod, got)
+		}
+	}
+}
+
+func TestAllocatedDevicesOfReplicas(t *testing.T) {
+	allocated := allocatedDevices(testReplicaAllocations(t))
+	if len(allocated) != 1 || !allocated[testGPUUUID] {
+		t.Errorf("allocated devices %v, want only %s", allocated, testGPUUUID)
+	}
+}
+
+func TestPodMemoryLimitsOfReplicas(t *testing.T) {
+	t.Cleanup(podGpuMemoryLimit.Reset)
+	allocations := testReplicaAllocations(t)
+	// A second container of the trainer holding another replica of the GPU
+	allocations = append(allocations, gpuAllocation{
+		namespace: "ml", pod: "trainer", container: "eval",
+		resource: "nvidia.com/gpu", deviceIDs: []string{testGPUUUID},
+	})
+	setPodMemoryLimits(allocations, map[string]uint64{testGPUUUID: 80 << 30})
+	for _, pod := range []string{"trainer", "notebook"} {
+		if got := testutil.ToFloat64(podGpuMemoryLimit.WithLabelValues("ml", pod)); got != 80<<30 {
+			t.Errorf("pod_gpu_memory_limit_bytes of %s = %v, want %v", pod, got, 80<<30)
+		}
+	}
+}
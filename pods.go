@@ -0,0 +1,364 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// gpuPod is a pod scanned in the current cycle together with the PIDs found
+// in its containers.
+type gpuPod struct {
+	pod *corev1.Pod
+	// How the pod got access to the GPU: device-plugin or env-injected
+	accessMode string
+	// PIDs listed in each container, by container name (exec PID source)
+	pids map[string][]string
+}
+
+// containerKey identifies a container of a pod in the podIndex. The
+// container is empty when a process could only be attributed to the pod.
+type containerKey struct {
+	pod       string
+	container string
+}
+
+// podIndex resolves the GPU processes of a cycle to the pods scanned in it.
+type podIndex struct {
+	// Pods by namespace/name
+	pods map[string]*gpuPod
+	// Containers by the PIDs found in them (exec PID source). The PIDs are
+	// those of the container PID namespace, so several containers usually
+	// share the low ones.
+	byPID map[string][]containerKey
+	// Pod keys by pod UID and containers by container ID
+	byUID         map[types.UID]string
+	byContainerID map[string]containerKey
+	// Containers allocated each device by the kubelet, by the UUID of the
+	// GPU or MIG instance
+	byDevice map[string][]containerKey
+}
+
+func newPodIndex() *podIndex {
+	return &podIndex{
+		pods:          make(map[string]*gpuPod),
+		byPID:         make(map[string][]containerKey),
+		byUID:         make(map[types.UID]string),
+		byContainerID: make(map[string]containerKey),
+		byDevice:      make(map[string][]containerKey),
+	}
+}
+
+func (idx *podIndex) add(p *gpuPod) {
+	key := p.pod.Namespace + "/" + p.pod.Name
+	idx.pods[key] = p
+	idx.byUID[p.pod.UID] = key
+	for _, status := range p.pod.Status.ContainerStatuses {
+		if id := trimContainerID(status.ContainerID); id != "" {
+			idx.byContainerID[id] = containerKey{pod: key, container: status.Name}
+		}
+	}
+	for container, pids := range p.pids {
+		for _, pid := range pids {
+			idx.byPID[pid] = append(idx.byPID[pid], containerKey{pod: key, container: container})
+		}
+	}
+}
+
+// addAllocations indexes the containers of the scanned pods by the devices
+// the kubelet allocated to them.
+func (idx *podIndex) addAllocations(allocations []gpuAllocation) {
+	for _, a := range allocations {
+		key := a.namespace + "/" + a.pod
+		if _, ok := idx.pods[key]; !ok {
+			continue
+		}
+		for _, id := range a.deviceIDs {
+			idx.byDevice[id] = append(idx.byDevice[id], containerKey{pod: key, container: a.container})
+		}
+	}
+}
+
+// lookup returns the container running the host process pid on the device
+// uuid. With the cgroup PID source the pod UID and container ID are read
+// from the process cgroup, otherwise the PID is looked up among those listed
+// in each container. When the kubelet allocated the device (e.g. a MIG
+// instance) to containers, processes whose pod is known but not their
+// container are attributed to the container of the pod granted the device.
+func (idx *podIndex) lookup(pid uint32, uuid string) (containerKey, bool) {
+	if len(idx.pods) == 0 {
+		return containerKey{}, false
+	}
+	allocated := idx.byDevice[uuid]
+
+	var c containerKey
+	var ok bool
+	if *pidSource == "cgroup" {
+		c, ok = idx.lookupCgroup(pid)
+	} else if c, ok = idx.lookupExec(pid, allocated); !ok && len(allocated) > 0 {
+		// The PID wasn't listed in any container, e.g. exec failed
+		c, ok = idx.lookupCgroup(pid)
+	}
+	if !ok {
+		return containerKey{}, false
+	}
+	if c.container == "" {
+		for _, a := range allocated {
+			if a.pod == c.pod {
+				return a, true
+			}
+		}
+	}
+	return c, true
+}
+
+func (idx *podIndex) lookupCgroup(pid uint32) (containerKey, bool) {
+	uid, containerID, err := processPodCgroup(pid)
+	if err != nil {
+		log.Printf("Unable to read cgroup of GPU process %d: %v", pid, err)
+		return containerKey{}, false
+	}
+	if c, ok := idx.byContainerID[containerID]; ok {
+		return c, true
+	}
+	key, ok := idx.byUID[types.UID(uid)]
+	return containerKey{pod: key}, ok
+}
+
+// lookupExec matches the PIDs of the process in each of its PID namespaces
+// (NSpid) against the PIDs listed in the containers, so processes in nested
+// PID namespaces are found by the PID the container sees. When several
+// containers list a matching PID the process cgroup decides, or else the
+// containers allocated the device.
+func (idx *podIndex) lookupExec(pid uint32, allocated []containerKey) (containerKey, bool) {
+	nspids, err := processNSpids(pid)
+	if err != nil {
+		nspids = []string{strconv.FormatUint(uint64(pid), 10)}
+	}
+
+	var candidates []containerKey
+	seen := make(map[containerKey]bool)
+	for _, nspid := range nspids {
+		for _, c := range idx.byPID[nspid] {
+			if !seen[c] {
+				seen[c] = true
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return containerKey{}, false
+	case 1:
+		return candidates[0], true
+	}
+
+	if c, ok := idx.lookupCgroup(pid); ok {
+		for _, candidate := range candidates {
+			if candidate.pod == c.pod && (c.container == "" || candidate.container == c.container) {
+				return candidate, true
+			}
+		}
+	}
+	var granted []containerKey
+	for _, candidate := range candidates {
+		for _, a := range allocated {
+			if candidate == a {
+				granted = append(granted, candidate)
+			}
+		}
+	}
+	if len(granted) == 1 {
+		return granted[0], true
+	}
+	log.Printf("GPU process %d matches PIDs in %d containers, not attributing it", pid, len(candidates))
+	return containerKey{}, false
+}
+
+// trimContainerID strips the runtime prefix ("containerd://" or similar)
+// from a container status ID.
+func trimContainerID(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
+
+var (
+	exporterStartTime = time.Now()
+	// Pods whose first GPU use was already observed, by UID
+	firstGPUUseReported = make(map[types.UID]bool)
+)
+
+// parseResourceNames splits a comma-separated list of extended resource
+// names. Entries ending in "*" match every resource name with that prefix.
+func parseResourceNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// systemNamespaces are the namespaces excluded by default, which rarely run
+// GPU workloads and often forbid exec.
+var systemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// excludedNamespaces returns the set of -exclude-namespaces, without the
+// system namespaces when -scan-system-namespaces is set.
+func excludedNamespaces() map[string]bool {
+	excluded := make(map[string]bool)
+	for _, namespace := range strings.Split(*excludeNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			excluded[namespace] = true
+		}
+	}
+	if *scanSystemNamespaces {
+		for _, namespace := range systemNamespaces {
+			delete(excluded, namespace)
+		}
+	}
+	return excluded
+}
+
+func resourceMatches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// requestsGPU reports whether any container of the pod requests a GPU
+// resource matching one of patterns. Extended resources must be set as
+// limits, but requests are checked as well.
+func requestsGPU(pod *corev1.Pod, patterns []string) bool {
+	containers := slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers)
+	for _, container := range containers {
+		for _, resources := range []corev1.ResourceList{container.Resources.Limits, container.Resources.Requests} {
+			for name, quantity := range resources {
+				if !quantity.IsZero() && resourceMatches(string(name), patterns) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// devicePluginResources are the resources the NVIDIA device plugin grants
+// GPUs through, including renamed time-sliced ones (nvidia.com/gpu.shared).
+// They decide the access mode whatever -gpu-resource-names is set to.
+var devicePluginResources = []string{"nvidia.com/gpu*", "nvidia.com/mig-*"}
+
+// scansPod reports whether the pod passes the -gpu-resource-names filter:
+// it requests one of the resources, or sets NVIDIA_VISIBLE_DEVICES. An
+// empty filter scans every pod.
+func scansPod(pod *corev1.Pod, gpuResources []string) bool {
+	return len(gpuResources) == 0 || requestsGPU(pod, gpuResources) || injectsGPUEnv(pod)
+}
+
+// gpuAccessMode returns how the pod gets access to its GPUs: device-plugin
+// when it requests a device plugin GPU resource, env-injected when it sets
+// NVIDIA_VISIBLE_DEVICES in its spec without one, and unknown otherwise,
+// e.g. when the image sets the variable.
+func gpuAccessMode(pod *corev1.Pod) string {
+	switch {
+	case requestsGPU(pod, devicePluginResources):
+		return "device-plugin"
+	case injectsGPUEnv(pod):
+		return "env-injected"
+	default:
+		return "unknown"
+	}
+}
+
+// visibleDevicesEnv is set by the NVIDIA container runtime to select the
+// GPUs exposed to a container, bypassing the device plugin when set by hand.
+const visibleDevicesEnv = "NVIDIA_VISIBLE_DEVICES"
+
+// injectsGPUEnv reports whether any container of the pod sets
+// NVIDIA_VISIBLE_DEVICES to expose GPUs. Values set in the image rather than
+// the pod spec can't be seen here.
+func injectsGPUEnv(pod *corev1.Pod) bool {
+	containers := slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.Name != visibleDevicesEnv {
+				continue
+			}
+			if env.ValueFrom != nil {
+				return true
+			}
+			switch strings.TrimSpace(env.Value) {
+			case "", "void", "none":
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// podStartTime returns when the pod started running: its StartTime, or the
+// earliest StartedAt of its running containers if that isn't set yet.
+func podStartTime(pod *corev1.Pod) (time.Time, bool) {
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time, true
+	}
+	var start time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			continue
+		}
+		if started := status.State.Running.StartedAt.Time; start.IsZero() || started.Before(start) {
+			start = started
+		}
+	}
+	return start, !start.IsZero()
+}
+
+// observeFirstGPUUse records the time from the pod starting to its first
+// attributed GPU process, once per pod. Pods started before the exporter are
+// skipped since their first use can't be known.
+func observeFirstGPUUse(pod *corev1.Pod) {
+	if firstGPUUseReported[pod.UID] {
+		return
+	}
+	start, ok := podStartTime(pod)
+	if !ok {
+		return
+	}
+	firstGPUUseReported[pod.UID] = true
+	if start.Before(exporterStartTime) {
+		return
+	}
+	podGpuFirstUseLatency.Observe(time.Since(start).Seconds())
+}
+
+// pruneFirstGPUUse forgets pods that no longer exist.
+func pruneFirstGPUUse(pods []corev1.Pod) {
+	current := make(map[types.UID]bool, len(pods))
+	for _, pod := range pods {
+		current[pod.UID] = true
+	}
+	for uid := range firstGPUUseReported {
+		if !current[uid] {
+			delete(firstGPUUseReported, uid)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var resource1 = resource.MustParse("1")
+
+// testGPUPod returns a scanned pod whose containers list pids.
+func testGPUPod(namespace, name, uid string, pids map[string][]string) *gpuPod {
+	return &gpuPod{
+		pod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(uid)},
+		},
+		accessMode: "device-plugin",
+		pids:       pids,
+	}
+}
+
+func TestLookupExecInnermostPID(t *testing.T) {
+	root := withProcRoot(t)
+	// The process is PID 7 in the container, nested in an intermediate
+	// PID namespace (e.g. a sandbox) where it is PID 100
+	writeProcFile(t, root, "4242", "status", "Name:\tpython\nNSpid:\t4242\t100\t7\n")
+
+	idx := newPodIndex()
+	idx.add(testGPUPod("ml", "trainer", testPodUID, map[string][]string{"train": {"1", "7"}}))
+	idx.add(testGPUPod("ml", "other", "11111111-2222-3333-4444-555555555555", map[string][]string{"main": {"1", "12"}}))
+
+	got, ok := idx.lookupExec(4242, nil)
+	want := containerKey{pod: "ml/trainer", container: "train"}
+	if !ok || got != want {
+		t.Errorf("lookupExec = %v, %v, want %v, true", got, ok, want)
+	}
+
+	// Without NSpid only the host PID is tried, which no container lists
+	writeProcFile(t, root, "4242", "status", "Name:\tpython\n")
+	if got, ok := idx.lookupExec(4242, nil); ok {
+		t.Errorf("lookupExec without NSpid = %v, want no match", got)
+	}
+}
+
+func TestLookupByMIGAllocation(t *testing.T) {
+	const (
+		migA = "MIG-1a2b3c4d-0000-5e6f-7a8b-9c0d1e2f3a4b"
+		migB = "MIG-5e6f7a8b-1111-9c0d-1e2f-3a4b5c6d7e8f"
+	)
+	root := withProcRoot(t)
+	// Both processes are PID 7 in their container and their cgroups can't
+	// be read, so only the allocations tell them apart
+	writeProcFile(t, root, "5001", "status", "Name:\tpython\nNSpid:\t5001\t7\n")
+	writeProcFile(t, root, "5002", "status", "Name:\tpython\nNSpid:\t5002\t7\n")
+
+	idx := newPodIndex()
+	idx.add(testGPUPod("team-a", "infer", "aaaaaaaa-0000-0000-0000-000000000001", map[string][]string{"server": {"1", "7"}}))
+	idx.add(testGPUPod("team-b", "infer", "bbbbbbbb-0000-0000-0000-000000000002", map[string][]string{"server": {"1", "7"}}))
+	idx.addAllocations([]gpuAllocation{
+		{namespace: "team-a", pod: "infer", container: "server", resource: "nvidia.com/mig-3g.40gb", deviceIDs: []string{migA}},
+		{namespace: "team-b", pod: "infer", container: "server", resource: "nvidia.com/mig-3g.40gb", deviceIDs: []string{migB}},
+	})
+
+	tests := []struct {
+		pid  uint32
+		uuid string
+		want containerKey
+	}{
+		{5001, migA, containerKey{pod: "team-a/infer", container: "server"}},
+		{5002, migB, containerKey{pod: "team-b/infer", container: "server"}},
+	}
+	for _, tt := range tests {
+		got, ok := idx.lookup(tt.pid, tt.uuid)
+		if !ok || got != tt.want {
+			t.Errorf("lookup(%d, %s) = %v, %v, want %v, true", tt.pid, tt.uuid, got, ok, tt.want)
+		}
+	}
+
+	// On a slice allocated to neither pod the process stays unattributed
+	if got, ok := idx.lookup(5001, "MIG-unallocated"); ok {
+		t.Errorf("lookup on an unallocated slice = %v, want no match", got)
+	}
+}
+
+func TestContainerScansDontModifyPodSpec(t *testing.T) {
+	// Spare capacity, as in objects shared with the informer cache
+	initContainers := make([]corev1.Container, 1, 2)
+	initContainers[0] = corev1.Container{Name: "init"}
+	spare := initContainers[:2]
+	spare[1] = corev1.Container{Name: "spare"}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: initContainers,
+		Containers:     []corev1.Container{{Name: "main", Env: []corev1.EnvVar{{Name: visibleDevicesEnv, Value: "all"}}}},
+	}}
+
+	requestsGPU(pod, []string{"nvidia.com/gpu"})
+	if !injectsGPUEnv(pod) {
+		t.Error("injectsGPUEnv = false, want true")
+	}
+	if spare[1].Name != "spare" {
+		t.Errorf("backing array of InitContainers was overwritten with %q", spare[1].Name)
+	}
+}
+
+func TestGPUAccessMode(t *testing.T) {
+	gpuLimit := func(resource string) corev1.Container {
+		return corev1.Container{Name: "main", Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceName(resource): resource1},
+		}}
+	}
+	visibleDevices := corev1.EnvVar{Name: visibleDevicesEnv, Value: "all"}
+
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		// Whether the pod is scanned with the default -gpu-resource-names
+		wantScanned bool
+		wantMode    string
+	}{
+		{"device plugin", []corev1.Container{gpuLimit("nvidia.com/gpu")}, true, "device-plugin"},
+		{"MIG", []corev1.Container{gpuLimit("nvidia.com/mig-3g.40gb")}, true, "device-plugin"},
+		{"renamed time-sliced", []corev1.Container{gpuLimit("nvidia.com/gpu.shared")}, false, "device-plugin"},
+		{"device plugin and env", []corev1.Container{func() corev1.Container {
+			c := gpuLimit("nvidia.com/gpu")
+			c.Env = []corev1.EnvVar{visibleDevices}
+			return c
+		}()}, true, "device-plugin"},
+		{"env only", []corev1.Container{{Name: "main", Env: []corev1.EnvVar{visibleDevices}}}, true, "env-injected"},
+		{"neither", []corev1.Container{{Name: "main"}}, false, "unknown"},
+	}
+	filters := map[string][]string{
+		"default": parseResourceNames("nvidia.com/gpu,nvidia.com/mig-*"),
+		"empty":   parseResourceNames(""),
+	}
+	for _, tt := range tests {
+		for filter, gpuResources := range filters {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			wantScanned := tt.wantScanned || filter == "empty"
+			if got := scansPod(pod, gpuResources); got != wantScanned {
+				t.Errorf("%s, %s filter: scansPod = %v, want %v", tt.name, filter, got, wantScanned)
+			}
+			if got := gpuAccessMode(pod); got != tt.wantMode {
+				t.Errorf("%s, %s filter: gpuAccessMode = %q, want %q", tt.name, filter, got, tt.wantMode)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var informerSyncDuration = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "gpu_exporter_informer_sync_duration_seconds",
+		Help: "Time the pod informer took to sync its cache at startup",
+	},
+)
+
+// podLister lists the pods scanned in a cycle.
+type podLister interface {
+	listPods() ([]corev1.Pod, error)
+}
+
+// nodeSelector returns the field selector matching the pods of nodeName, or
+// an empty selector matching every pod when the node name isn't known.
+func nodeSelector(nodeName string) string {
+	if nodeName == "" {
+		return ""
+	}
+	return fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+}
+
+// apiPodLister lists the pods from the API server every cycle.
+type apiPodLister struct {
+	clientset *kubernetes.Clientset
+	nodeName  string
+}
+
+func (l apiPodLister) listPods() ([]corev1.Pod, error) {
+	// get pods in all the namespaces by omitting namespace
+	options := metav1.ListOptions{FieldSelector: nodeSelector(l.nodeName)}
+	podList, err := l.clientset.CoreV1().Pods("").List(context.TODO(), options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %v", err)
+	}
+	return podList.Items, nil
+}
+
+// informerPodLister lists the pods from the cache of a pod informer, which
+// is kept up to date by a watch instead of listing every cycle.
+type informerPodLister struct {
+	lister listersv1.PodLister
+}
+
+func (l informerPodLister) listPods() ([]corev1.Pod, error) {
+	cached, err := l.lister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cached pods: %v", err)
+	}
+	pods := make([]corev1.Pod, 0, len(cached))
+	for _, pod := range cached {
+		pods = append(pods, *pod)
+	}
+	return pods, nil
+}
+
+// startPodInformer starts a pod informer and waits for its cache to sync.
+// Only the pods of nodeName are watched unless it is empty.
+func startPodInformer(clientset *kubernetes.Clientset, nodeName string, stop <-chan struct{}) (podLister, error) {
+	selector := nodeSelector(nodeName)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = selector
+		}))
+	podInformer := factory.Core().V1().Pods()
+	informer := podInformer.Informer()
+	factory.Start(stop)
+
+	start := time.Now()
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return nil, fmt.Errorf("pod informer cache did not sync")
+	}
+	informerSyncDuration.Set(time.Since(start).Seconds())
+	log.Printf("Pod informer synced in %v", time.Since(start))
+	return informerPodLister{lister: podInformer.Lister()}, nil
+}
+
+// ready is set once the pod source can be used, so scrapes before the
+// informer synced don't see zero pods.
+var ready atomic.Bool
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "pod source not synced", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
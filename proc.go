@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userHZ is the unit of the time fields in /proc/<pid>/stat. It is 100 on
+// all architectures Kubernetes GPU nodes run on.
+const userHZ = 100
+
+// processExists reports whether pid is present in the host /proc.
+// The exporter needs hostPID (or the host /proc mounted at -proc-root)
+// for this to reflect host processes rather than its own namespace.
+func processExists(pid uint32) bool {
+	_, err := os.Stat(filepath.Join(*procRoot, strconv.FormatUint(uint64(pid), 10)))
+	return err == nil
+}
+
+var (
+	bootTimeOnce sync.Once
+	bootTime     time.Time
+	bootTimeErr  error
+)
+
+// hostBootTime returns the boot time of the host from the btime line of
+// /proc/stat.
+func hostBootTime() (time.Time, error) {
+	bootTimeOnce.Do(func() {
+		data, err := os.ReadFile(filepath.Join(*procRoot, "stat"))
+		if err != nil {
+			bootTimeErr = err
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "btime "); ok {
+				seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				if err != nil {
+					bootTimeErr = fmt.Errorf("invalid btime %q: %v", value, err)
+					return
+				}
+				bootTime = time.Unix(seconds, 0)
+				return
+			}
+		}
+		bootTimeErr = fmt.Errorf("btime not found in %s/stat", *procRoot)
+	})
+	return bootTime, bootTimeErr
+}
+
+// processStartTime returns when pid was started, from the starttime field
+// of /proc/<pid>/stat.
+func processStartTime(pid uint32) (time.Time, error) {
+	boot, err := hostBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(*procRoot, strconv.FormatUint(uint64(pid), 10), "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseStartTime(data, pid, boot)
+}
+
+// parseStartTime returns the start time of pid from the contents of its
+// /proc/<pid>/stat, given the boot time of the host.
+func parseStartTime(data []byte, pid uint32, boot time.Time) (time.Time, error) {
+	// The command name may contain spaces and parentheses, so fields are
+	// counted from the last ')'. starttime is field 22; state is field 3.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return time.Time{}, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid starttime for pid %d: %v", pid, err)
+	}
+	// Multiplying ticks by time.Second first overflows after about three
+	// years of uptime.
+	return boot.Add(time.Duration(ticks) * (time.Second / userHZ)), nil
+}
+
+// processNSpids returns the PIDs of a host process in each PID namespace it
+// belongs to, from the NSpid line of /proc/<pid>/status. The first entry is
+// the host PID and the last one the PID in the innermost namespace, which is
+// what a command run inside the container sees. Kernels without NSpid only
+// report the host PID.
+func processNSpids(pid uint32) ([]string, error) {
+	hostPID := strconv.FormatUint(uint64(pid), 10)
+	data, err := os.ReadFile(filepath.Join(*procRoot, hostPID, "status"))
+	if err != nil {
+		return nil, err
+	}
+	return parseNSpids(data, hostPID), nil
+}
+
+func parseNSpids(status []byte, hostPID string) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "NSpid:"); ok {
+			if pids := strings.Fields(value); len(pids) > 0 {
+				return pids
+			}
+		}
+	}
+	return []string{hostPID}
+}
+
+// execCommandArgs turns the -exec-command template into the argument list
+// passed after "kubectl exec ... --". Commands using shell features such as
+// globs or pipes (e.g. "cat /proc/*/stat") are run through "sh -c".
+func execCommandArgs(command string) []string {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return nil
+	}
+	if strings.ContainsAny(command, "*?[]|;&<>$`'\"") {
+		return []string{"sh", "-c", command}
+	}
+	return strings.Fields(command)
+}
+
+// parsePIDs extracts PIDs from the output of the exec command. The first
+// field of every line is taken as the PID, which covers both "ps -o pid="
+// and /proc/<pid>/stat style output; lines not starting with a number are
+// ignored.
+func parsePIDs(output []byte) []string {
+	var pids []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 32); err != nil {
+			continue
+		}
+		pids = append(pids, fields[0])
+	}
+	return pids
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseNSpids(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   []string
+	}{
+		{
+			name:   "single level",
+			status: "Name:\tpython\nPid:\t4242\nNSpid:\t4242\n",
+			want:   []string{"4242"},
+		},
+		{
+			name:   "two levels",
+			status: "Name:\tpython\nPid:\t4242\nNSpid:\t4242\t7\nNSpgid:\t4242\t7\n",
+			want:   []string{"4242", "7"},
+		},
+		{
+			name:   "three levels",
+			status: "Name:\tpython\nPid:\t4242\nNSpid:\t4242\t100\t7\n",
+			want:   []string{"4242", "100", "7"},
+		},
+		{
+			name:   "no NSpid line",
+			status: "Name:\tpython\nPid:\t4242\nPPid:\t1\n",
+			want:   []string{"4242"},
+		},
+		{
+			name:   "empty NSpid line",
+			status: "Name:\tpython\nNSpid:\n",
+			want:   []string{"4242"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNSpids([]byte(tt.status), "4242"); !slices.Equal(got, tt.want) {
+				t.Errorf("parseNSpids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessNSpids(t *testing.T) {
+	root := withProcRoot(t)
+	writeProcFile(t, root, "4242", "status", "Name:\tpython\nNSpid:\t4242\t100\t7\n")
+
+	got, err := processNSpids(4242)
+	if err != nil {
+		t.Fatalf("processNSpids: %v", err)
+	}
+	if want := []string{"4242", "100", "7"}; !slices.Equal(got, want) {
+		t.Errorf("processNSpids = %v, want %v", got, want)
+	}
+	if _, err := processNSpids(1); err == nil {
+		t.Error("processNSpids of a missing process succeeded")
+	}
+}
+
+// testStat returns a /proc/<pid>/stat line of a process named comm started
+// ticks clock ticks after boot.
+func testStat(comm string, ticks uint64) string {
+	return fmt.Sprintf("4242 (%s) S 1 4242 4242 0 -1 4194560 1200 0 0 0 15 3 0 0 20 0 8 0 %d 123456789 2048 18446744073709551615 1 1 0 0 0 0 0 16781312 134234626 0 0 0 17 3 0 0 0 0 0\n", comm, ticks)
+}
+
+func TestParseStartTime(t *testing.T) {
+	boot := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		stat  string
+		want  time.Time
+		error bool
+	}{
+		{
+			name: "plain command",
+			stat: testStat("python", 12345),
+			want: boot.Add(123450 * time.Millisecond),
+		},
+		{
+			name: "command with spaces and parentheses",
+			stat: testStat("train (rank 0) )", 12345),
+			want: boot.Add(123450 * time.Millisecond),
+		},
+		{
+			name: "three years of uptime",
+			stat: testStat("python", 3*365*24*3600*userHZ),
+			want: boot.Add(3 * 365 * 24 * time.Hour),
+		},
+		{
+			name:  "no command",
+			stat:  "4242 S 1",
+			error: true,
+		},
+		{
+			name:  "truncated",
+			stat:  "4242 (python) S 1 4242 4242 0\n",
+			error: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStartTime([]byte(tt.stat), 4242, boot)
+			if tt.error {
+				if err == nil {
+					t.Errorf("parseStartTime = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStartTime: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseStartTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handleRefreshCauses are the causes handleRefreshes is initialized with.
+// The exporter has no NVML watchdog re-initializing the library, so
+// watchdog_reinit is not among them.
+var handleRefreshCauses = []string{"count_changed", "device_lost", "mig_reconfig"}
+
+var handleRefreshes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gpu_exporter_handle_refresh_total",
+		Help: "Number of times the GPU device handles seen by the exporter changed, by cause",
+	},
+	[]string{"cause"},
+)
+
+var (
+	// Device count of the previous cycle, -1 before the first one
+	lastDeviceCount = -1
+
+	lostMu sync.Mutex
+	// Indexes of the GPUs NVML reports as lost
+	lostDevices = make(map[int]bool)
+
+	migLayoutsMu sync.Mutex
+	// UUIDs of the MIG instances of each physical GPU in the previous cycle,
+	// by UUID of the GPU
+	migLayouts = make(map[string]string)
+)
+
+// observeDeviceCount counts a refresh when the number of GPUs changed since
+// the previous cycle, e.g. after a hot-plug or a GPU falling off the bus.
+func observeDeviceCount(count int) {
+	if lastDeviceCount >= 0 && count != lastDeviceCount {
+		log.Printf("GPU count changed from %d to %d", lastDeviceCount, count)
+		handleRefreshes.WithLabelValues("count_changed").Inc()
+	}
+	lastDeviceCount = count
+}
+
+// observeDeviceLost counts a refresh when NVML starts reporting the GPU at
+// index di as lost, after which its handles are unusable until the driver
+// recovers. ret is the result of the latest call on the GPU.
+func observeDeviceLost(di int, ret nvml.Return) {
+	lostMu.Lock()
+	defer lostMu.Unlock()
+	if ret != nvml.ERROR_GPU_IS_LOST {
+		if ret == nvml.SUCCESS {
+			delete(lostDevices, di)
+		}
+		return
+	}
+	if !lostDevices[di] {
+		log.Printf("GPU at index %d is lost", di)
+		handleRefreshes.WithLabelValues("device_lost").Inc()
+		lostDevices[di] = true
+	}
+}
+
+// observeMigLayout counts a refresh when the MIG instances of the physical
+// GPU uuid changed since the previous cycle, including MIG being enabled
+// or disabled.
+func observeMigLayout(uuid string, devices []DeviceStats) {
+	instances := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if d.UUID != uuid {
+			instances = append(instances, d.UUID)
+		}
+	}
+	slices.Sort(instances)
+	layout := strings.Join(instances, ",")
+
+	migLayoutsMu.Lock()
+	defer migLayoutsMu.Unlock()
+	if previous, ok := migLayouts[uuid]; ok && previous != layout {
+		log.Printf("MIG instances of GPU %s changed", uuid)
+		handleRefreshes.WithLabelValues("mig_reconfig").Inc()
+	}
+	migLayouts[uuid] = layout
+}
+
+// migInstances returns the UUIDs of the MIG instances of the physical GPU
+// uuid seen in the previous cycle.
+func migInstances(uuid string) []string {
+	migLayoutsMu.Lock()
+	defer migLayoutsMu.Unlock()
+	if migLayouts[uuid] == "" {
+		return nil
+	}
+	return strings.Split(migLayouts[uuid], ",")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectionSuccessRatio = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "gpu_exporter_collection_success_ratio",
+		Help: "Fraction of the last -success-window collection cycles that completed without error or panic",
+	},
+)
+
+// cycleWindow is a ring buffer of the results of the most recent
+// collection cycles.
+type cycleWindow struct {
+	mu        sync.Mutex
+	results   []bool
+	next      int
+	filled    bool
+	successes int
+}
+
+func newCycleWindow(size int) *cycleWindow {
+	return &cycleWindow{results: make([]bool, size)}
+}
+
+// record adds the result of a cycle, evicting the oldest one once the
+// window is full, and returns the success ratio over the window.
+func (w *cycleWindow) record(success bool) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.filled && w.results[w.next] {
+		w.successes--
+	}
+	w.results[w.next] = success
+	if success {
+		w.successes++
+	}
+	w.next = (w.next + 1) % len(w.results)
+	if w.next == 0 {
+		w.filled = true
+	}
+
+	count := w.next
+	if w.filled {
+		count = len(w.results)
+	}
+	return float64(w.successes) / float64(count)
+}
+
+var cycleResults *cycleWindow
+
+func recordCycle(success bool) {
+	collectionSuccessRatio.Set(cycleResults.record(success))
+}
+
+var loopHeartbeat = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "gpu_exporter_loop_heartbeat_timestamp_seconds",
+		Help: "Unix time the last collection cycle started, or the loop last ran outside -collection-schedule",
+	},
+)
+
+// lastHeartbeat is the Unix time in nanoseconds of the last heartbeat, zero
+// until the first cycle started.
+var lastHeartbeat atomic.Int64
+
+func heartbeat() {
+	now := time.Now()
+	lastHeartbeat.Store(now.UnixNano())
+	loopHeartbeat.Set(float64(now.Unix()))
+}
+
+// healthzHandler fails when no collection cycle started for three
+// intervals, which means the collection loop is wedged (e.g. deadlocked or
+// stuck in an NVML or API call) even though the process is alive. Before
+// the first cycle, e.g. while the pod informer syncs, it reports healthy;
+// /readyz covers startup.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	last := lastHeartbeat.Load()
+	if last != 0 {
+		if age := time.Since(time.Unix(0, last)); age > 3*(*collectionInterval) {
+			http.Error(w, fmt.Sprintf("last collection cycle started %v ago", age.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
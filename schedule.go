@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectionWindowOpen = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "gpu_exporter_collection_window_open",
+		Help: "Whether the current time is inside -collection-schedule (1) or collection is paused (0)",
+	},
+)
+
+// schedule is a parsed cron expression. Every minute it matches is part of
+// a collection window.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether day of month and day of week were restricted, i.e. didn't
+	// start with "*"; when both are, cron matches days satisfying either
+	domRestricted, dowRestricted bool
+}
+
+// parseSchedule parses a standard 5-field cron expression (minute, hour,
+// day of month, month, day of week). Fields are "*", values, ranges
+// ("9-17") and steps ("*/15", "0-30/10"), comma-separated. Day of week is 0
+// to 7, both 0 and 7 being Sunday.
+func parseSchedule(s string) (*schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var sched schedule
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.domRestricted = !strings.HasPrefix(fields[2], "*")
+	sched.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return &sched, nil
+}
+
+// parseCronField returns the set of values between min and max a cron
+// field matches, as a bitmask.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepSpec); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepSpec)
+			}
+		}
+
+		low, high := min, max
+		if rangeSpec != "*" {
+			lowSpec, highSpec, isRange := strings.Cut(rangeSpec, "-")
+			var err error
+			if low, err = strconv.Atoi(lowSpec); err != nil {
+				return 0, fmt.Errorf("invalid value %q", lowSpec)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highSpec); err != nil {
+					return 0, fmt.Errorf("invalid value %q", highSpec)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the minute of t is part of the schedule.
+func (s *schedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatches := s.dom&(1<<t.Day()) != 0
+	dowMatches := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatches || dowMatches
+	}
+	return domMatches && dowMatches
+}
+
+// next returns the start of the first minute after t that is part of the
+// schedule, or the zero time if none is within the next 5 years (e.g. for
+// February 30).
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+var (
+	collectionSchedule *schedule
+	// Whether the previous cycle was inside the schedule
+	windowWasOpen = true
+)
+
+// inCollectionWindow reports whether a collection cycle should run at now,
+// logging when collection pauses or resumes.
+func inCollectionWindow(now time.Time) bool {
+	if collectionSchedule == nil {
+		return true
+	}
+
+	open := collectionSchedule.matches(now)
+	if open != windowWasOpen {
+		if open {
+			log.Printf("Entered -collection-schedule window, resuming collection")
+		} else if next := collectionSchedule.next(now); next.IsZero() {
+			log.Printf("Outside -collection-schedule, which matches no time in the next 5 years")
+		} else {
+			log.Printf("Outside -collection-schedule, pausing collection until %v", next.Format(time.RFC3339))
+		}
+		windowWasOpen = open
+	}
+	value := 0.0
+	if open {
+		value = 1
+	}
+	collectionWindowOpen.Set(value)
+	return open
+}
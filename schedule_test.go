@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		error    bool
+	}{
+		{field: "*", min: 0, max: 6, want: []int{0, 1, 2, 3, 4, 5, 6}},
+		{field: "5", min: 0, max: 59, want: []int{5}},
+		{field: "9-11", min: 0, max: 23, want: []int{9, 10, 11}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "0-30/10", min: 0, max: 59, want: []int{0, 10, 20, 30}},
+		{field: "50/5", min: 0, max: 59, want: []int{50, 55}},
+		{field: "1,3,5-6", min: 0, max: 7, want: []int{1, 3, 5, 6}},
+		{field: "0", min: 1, max: 31, error: true},
+		{field: "10-5", min: 0, max: 59, error: true},
+		{field: "*/0", min: 0, max: 59, error: true},
+		{field: "mon", min: 0, max: 7, error: true},
+		{field: "1-", min: 0, max: 7, error: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			got, err := parseCronField(tt.field, tt.min, tt.max)
+			if tt.error {
+				if err == nil {
+					t.Errorf("parseCronField = %b, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCronField: %v", err)
+			}
+			var want uint64
+			for _, v := range tt.want {
+				want |= 1 << v
+			}
+			if got != want {
+				t.Errorf("parseCronField = %b, want %b", got, want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 32 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	// 2024-03-04 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		spec string
+		time time.Time
+		want bool
+	}{
+		{name: "every minute", spec: "* * * * *", time: at(4, 3, 17), want: true},
+		{name: "working hours", spec: "* 8-18 * * 1-5", time: at(4, 18, 59), want: true},
+		{name: "after working hours", spec: "* 8-18 * * 1-5", time: at(4, 19, 0), want: false},
+		{name: "weekend", spec: "* 8-18 * * 1-5", time: at(9, 12, 0), want: false},
+		{name: "sunday as 7", spec: "* * * * 7", time: at(10, 12, 0), want: true},
+		{name: "sunday as 0", spec: "* * * * 0", time: at(10, 12, 0), want: true},
+		{name: "minute step", spec: "*/15 * * * *", time: at(4, 12, 45), want: true},
+		{name: "off minute step", spec: "*/15 * * * *", time: at(4, 12, 46), want: false},
+		{name: "other month", spec: "* * * 4 *", time: at(4, 12, 0), want: false},
+		// Day of month and day of week both restricted match either
+		{name: "either day, day of month", spec: "* * 1 * 1", time: at(1, 12, 0), want: true},
+		{name: "either day, day of week", spec: "* * 1 * 1", time: at(4, 12, 0), want: true},
+		{name: "either day, neither", spec: "* * 1 * 1", time: at(5, 12, 0), want: false},
+		// A field starting with "*" isn't restricted, even with a step
+		{name: "day of month step", spec: "* * */2 * 1", time: at(4, 12, 0), want: false},
+		{name: "day of month step, matching Monday", spec: "* * */2 * 1", time: at(11, 12, 0), want: true},
+		{name: "day of month step, matching day", spec: "* * */2 * 1", time: at(5, 12, 0), want: false},
+		{name: "day of week step", spec: "* * 5 * */2", time: at(7, 12, 0), want: false},
+		{name: "day of week step, matching day", spec: "* * 5 * */2", time: at(5, 12, 0), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := parseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("parseSchedule(%q): %v", tt.spec, err)
+			}
+			if got := sched.matches(tt.time); got != tt.want {
+				t.Errorf("%q matches %v = %v, want %v", tt.spec, tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	sched, err := parseSchedule("0 8 * * 1-5")
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	// From Friday evening to Monday morning
+	from := time.Date(2024, time.March, 8, 18, 30, 20, 0, time.UTC)
+	if got, want := sched.next(from), time.Date(2024, time.March, 11, 8, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next = %v, want %v", got, want)
+	}
+
+	never, err := parseSchedule("* * 30 2 *")
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	if got := never.next(from); !got.IsZero() {
+		t.Errorf("next of February 30 = %v, want the zero time", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// newPusher returns the pusher of -pushgateway-url, grouping the metrics of
+// each node under its own instance. It returns nil when no pushgateway is
+// configured.
+func newPusher(gatherer prometheus.Gatherer, nodeName string) *push.Pusher {
+	if *pushgatewayURL == "" {
+		return nil
+	}
+	instance := nodeName
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return push.New(*pushgatewayURL, "gpu_exporter").Gatherer(gatherer).Grouping("instance", instance)
+}
+
+// pushMetrics replaces the metrics of the exporter on the pushgateway.
+// After a regular cycle the push is bounded by -interval.
+func pushMetrics(ctx context.Context, pusher *push.Pusher) {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.PushContext(ctx); err != nil {
+		log.Printf("Unable to push metrics to %s: %v", *pushgatewayURL, err)
+	}
+}
+
+// serverShutdownTimeout bounds how long the metrics server waits for
+// in-flight scrapes when the exporter stops.
+const serverShutdownTimeout = 5 * time.Second
+
+// drain runs a final collection cycle, pushes its metrics and stops the
+// metrics server, so the last state of GPU jobs on a terminating node isn't
+// lost. It gives up on the cycle after -shutdown-timeout rather than
+// delaying the shutdown, and reports whether the cycle finished: until it
+// does, the cycle may still be calling into NVML.
+func drain(server *http.Server, pusher *push.Pusher, lister podLister, gpuResources, execArgs []string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	finished := false
+	done := make(chan struct{})
+	go func() {
+		runCycle(lister, gpuResources, execArgs)
+		close(done)
+	}()
+	select {
+	case <-done:
+		finished = true
+		pushMetrics(ctx, pusher)
+	case <-ctx.Done():
+		log.Printf("Final collection cycle did not finish within %v", *shutdownTimeout)
+	}
+
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer serverCancel()
+	if err := server.Shutdown(serverCtx); err != nil {
+		log.Printf("Unable to stop metrics server: %v", err)
+	}
+	return finished
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var slowCollectionTimestamp = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "gpu_exporter_slow_collection_timestamp_seconds",
+		Help: "Unix time of the last completed collection of the slow, rarely changing GPU metrics",
+	},
+)
+
+// runSlowCollector refreshes the slow collectors every -slow-interval,
+// independently of the main collection loop, so costly queries for rarely
+// changing metrics don't add to every cycle.
+func runSlowCollector() {
+	ticker := time.NewTicker(*slowInterval)
+	defer ticker.Stop()
+	for {
+		if collectionSchedule == nil || collectionSchedule.matches(time.Now()) {
+			runSlowCycle()
+		}
+		<-ticker.C
+	}
+}
+
+func runSlowCycle() {
+	defer recoverCycle("slow collection")
+
+	if err := collectSlow(); err != nil {
+		log.Printf("Slow collection cycle failed: %v", err)
+		return
+	}
+	slowCollectionTimestamp.SetToCurrentTime()
+}
+
+// collectSlow runs the slow collectors on every GPU, one at a time within
+// the -nvml-concurrency slots shared with the collection loop. A failing
+// GPU is logged and skipped, and fails the cycle once the others are done.
+func collectSlow() error {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to get device count: %v", nvml.ErrorString(ret))
+	}
+
+	var collectErr error
+	for di := 0; di < count; di++ {
+		if err := collectSlowGPU(di); err != nil {
+			log.Printf("Unable to collect slow metrics of GPU %d: %v", di, err)
+			if collectErr == nil {
+				collectErr = err
+			}
+		}
+	}
+	return collectErr
+}
+
+func collectSlowGPU(di int) error {
+	nvmlSlots <- struct{}{}
+	defer func() { <-nvmlSlots }()
+
+	device, ret := nvml.DeviceGetHandleByIndex(di)
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to get device at index %d: %v", di, nvml.ErrorString(ret))
+	}
+
+	uuid, ret := device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to get device UUID at index %d: %v", di, nvml.ErrorString(ret))
+	}
+	runDeviceCollectors(di, device, uuid, true)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gpuSMPartitionUtilization = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gpu_sm_partition_utilization_percent",
+		Help: "SM utilization of each MIG GPU instance of the GPU since the previous cycle, by GPU instance ID",
+	},
+	[]string{"gpu_index", "gpu_uuid", "partition"},
+)
+
+// maxSMPartitions bounds the partitions exported per GPU. MIG allows at
+// most 7 GPU instances.
+const maxSMPartitions = 8
+
+var (
+	gpmSamplesMu sync.Mutex
+	// Previous GPM sample of each GPU instance, by GPU UUID and instance ID
+	gpmSamples = make(map[string]map[int]nvml.GpmSample)
+)
+
+// collectSMPartitions exports the SM utilization of each MIG GPU instance
+// from GPU performance monitoring (Hopper and later), to spot load
+// imbalance across the partitions of a GPU. NVML has no per-SM activity, so
+// the partitions are the GPU instances; GPUs without MIG export nothing.
+// Utilization is computed between the samples of two cycles, so the first
+// cycle exports nothing either.
+func collectSMPartitions(device nvml.Device, labels []string) nvml.Return {
+	support, ret := device.GpmQueryDeviceSupport()
+	if ret != nvml.SUCCESS {
+		return ret
+	}
+	if support.IsSupportedDevice == 0 {
+		return nvml.ERROR_NOT_SUPPORTED
+	}
+
+	migs := migDevices(device)
+	if len(migs) > maxSMPartitions {
+		migs = migs[:maxSMPartitions]
+	}
+	gpmSamplesMu.Lock()
+	defer gpmSamplesMu.Unlock()
+	uuid := labels[1]
+	samples := gpmSamples[uuid]
+	if samples == nil {
+		samples = make(map[int]nvml.GpmSample)
+		gpmSamples[uuid] = samples
+	}
+	seen := make(map[int]bool, len(migs))
+	for _, mig := range migs {
+		instance, ret := mig.GetGpuInstanceId()
+		if ret != nvml.SUCCESS {
+			return ret
+		}
+		sample, ret := nvml.GpmSampleAlloc()
+		if ret != nvml.SUCCESS {
+			return ret
+		}
+		if ret := sample.MigGet(device, instance); ret != nvml.SUCCESS {
+			sample.Free()
+			return ret
+		}
+
+		seen[instance] = true
+		partition := strconv.Itoa(instance)
+		previous, ok := samples[instance]
+		samples[instance] = sample
+		if !ok {
+			continue
+		}
+		metrics := nvml.GpmMetricsGetType{
+			NumMetrics: 1,
+			Sample1:    previous,
+			Sample2:    sample,
+		}
+		metrics.Metrics[0].MetricId = uint32(nvml.GPM_METRIC_SM_UTIL)
+		ret = nvml.GpmMetricsGet(&metrics)
+		previous.Free()
+		if ret != nvml.SUCCESS {
+			return ret
+		}
+		if nvml.Return(metrics.Metrics[0].NvmlReturn) != nvml.SUCCESS {
+			return nvml.Return(metrics.Metrics[0].NvmlReturn)
+		}
+		gpuSMPartitionUtilization.WithLabelValues(labels[0], uuid, partition).Set(roundPercent(metrics.Metrics[0].Value))
+	}
+
+	// Free the samples of GPU instances removed by a MIG reconfiguration
+	for instance, sample := range samples {
+		if !seen[instance] {
+			sample.Free()
+			delete(samples, instance)
+			gpuSMPartitionUtilization.DeleteLabelValues(labels[0], uuid, strconv.Itoa(instance))
+		}
+	}
+	if len(samples) == 0 {
+		delete(gpmSamples, uuid)
+	}
+	return nvml.SUCCESS
+}
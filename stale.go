@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// processGauges are the device gauges collectDevice sets from the memory
+// and process list of a device handle.
+func processGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		gpuMemoryUsed,
+		gpuMemoryTotal,
+		gpuMemoryUsedPercent,
+		gpuProcesses,
+		gpuZombieProcessMemory,
+		gpuLongRunningProcesses,
+		gpuMemoryAttributed,
+		gpuMemoryUnattributed,
+	}
+}
+
+// physicalGauges are the gauges collectGPU sets per physical GPU from the
+// stats of its device handles.
+func physicalGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		gpuTenantNamespaces,
+		gpuMultiTenant,
+		gpuPhysicalMemoryUsed,
+		gpuPhysicalMemoryTotal,
+		gpuPhysicalProcesses,
+	}
+}
+
+// markGPUStale marks the process gauges of the GPU uuid and of its MIG
+// instances stale, along with its physical gauges, when one of its device
+// handles failed and the GPU is left out of the cycle.
+func markGPUStale(uuid string) {
+	for _, u := range append([]string{uuid}, migInstances(uuid)...) {
+		markStale(processGauges(), u, nil)
+	}
+	markStale(physicalGauges(), uuid, nil)
+}
+
+// markUnreachableStale marks every series of the GPU at index di stale when
+// it can't be reached at all, identifying it by the UUID last seen at the
+// index.
+func markUnreachableStale(di int) {
+	uuid, ok := cachedUUID(di)
+	if !ok {
+		return
+	}
+	markGPUStale(uuid)
+	for _, c := range deviceCollectors {
+		markStale(c.gauges, uuid, c.staleLabels)
+	}
+}
+
+// markStale sets the series of the device uuid in gauges to NaN, so a
+// failed collection shows up as a gap instead of the last value lingering
+// as if it were current. Only series also matching labels are marked.
+// The series recover with the next successful collection.
+func markStale(gauges []*prometheus.GaugeVec, uuid string, labels prometheus.Labels) {
+	for _, gauge := range gauges {
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			gauge.Collect(metrics)
+			close(metrics)
+		}()
+
+		var stale []prometheus.Labels
+		for m := range metrics {
+			var sample dto.Metric
+			if err := m.Write(&sample); err != nil {
+				continue
+			}
+			series := make(prometheus.Labels)
+			for _, pair := range sample.GetLabel() {
+				series[pair.GetName()] = pair.GetValue()
+			}
+			if series["gpu_uuid"] == uuid && labelsMatch(series, labels) {
+				stale = append(stale, series)
+			}
+		}
+		// Set after collecting, as Collect holds the lock of the vec
+		for _, series := range stale {
+			gauge.With(series).Set(math.NaN())
+		}
+	}
+}
+
+func labelsMatch(series, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		if series[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// terminatedPod is a GPU pod that was no longer listed in a cycle.
+type terminatedPod struct {
+	namespace string
+	name      string
+	// When the pod was last listed
+	lastSeen time.Time
+}
+
+// gpuPodsSeen holds the GPU pods listed in the previous cycle and the
+// terminated ones whose series are still exported, by namespace/name.
+var (
+	gpuPodsSeen    = make(map[string]*terminatedPod)
+	terminatedPods = make(map[string]*terminatedPod)
+)
+
+// podMetricVecs are the metrics with namespace and pod labels, whose series
+// are removed once a terminated pod's grace period is over.
+func podMetricVecs() []*prometheus.MetricVec {
+	return []*prometheus.MetricVec{
+		podGpuMemoryBytesSeconds.MetricVec,
+		podGpuMemoryBytes.MetricVec,
+		podGpuAccessMode.MetricVec,
+		podGpuTimeSliceShare.MetricVec,
+		podGpuMemoryLimit.MetricVec,
+		podGpuAllocationMismatch.MetricVec,
+	}
+}
+
+// pruneTerminatedPods tracks the GPU pods of the cycle and removes the series
+// of pods that disappeared more than -terminated-pod-grace ago. Until then
+// the series keep their last-known values, so dashboards show the pod
+// ramping down instead of a gap.
+func pruneTerminatedPods(pods *podIndex) {
+	if *terminatedPodGrace <= 0 {
+		return
+	}
+	now := time.Now()
+
+	current := make(map[string]*terminatedPod, len(pods.pods))
+	names := make(map[string]bool, len(pods.pods))
+	for key, p := range pods.pods {
+		current[key] = &terminatedPod{namespace: p.pod.Namespace, name: p.pod.Name, lastSeen: now}
+		names[p.pod.Name] = true
+		delete(terminatedPods, key)
+	}
+	for key, p := range gpuPodsSeen {
+		if _, ok := current[key]; !ok {
+			terminatedPods[key] = p
+		}
+	}
+	gpuPodsSeen = current
+
+	for key, p := range terminatedPods {
+		if now.Sub(p.lastSeen) < *terminatedPodGrace {
+			continue
+		}
+		delete(terminatedPods, key)
+		for _, vec := range podMetricVecs() {
+			vec.DeletePartialMatch(prometheus.Labels{"namespace": p.namespace, "pod": p.name})
+		}
+		// The legacy metrics only carry the pod name, so their series are
+		// kept while a pod of the same name runs in another namespace
+		if !names[p.name] {
+			podGpuMemoryUsed.DeletePartialMatch(prometheus.Labels{"pod": p.name})
+			podGpuMemoryPercUsed.DeletePartialMatch(prometheus.Labels{"pod": p.name})
+		}
+		log.Printf("Removed metrics of terminated pod %s", key)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var podGpuTimeSliceShare = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pod_gpu_time_slice_share_percent",
+		Help: "Part of the GPU utilization attributed to the pod, proportional to the SM utilization of its processes",
+	},
+	[]string{"namespace", "pod", "gpu_index", "gpu_uuid"},
+)
+
+var (
+	processSamplesMu sync.Mutex
+	// Timestamp of the newest process utilization sample seen, by GPU UUID
+	lastProcessSample = make(map[string]uint64)
+)
+
+// collectTimeSliceShares splits the utilization of a device among the pods
+// running on it, in proportion to the SM utilization of their processes.
+// podProcesses maps the pod keys to their PIDs on the device.
+func collectTimeSliceShares(gpuIndex, uuid string, device nvml.Device, pods *podIndex, podProcesses map[string][]uint32) {
+	if len(podProcesses) == 0 {
+		return
+	}
+
+	utilization, ret := device.GetUtilizationRates()
+	if ret != nvml.SUCCESS {
+		// Not available on MIG instances and some older GPUs
+		return
+	}
+
+	processSamplesMu.Lock()
+	since := lastProcessSample[uuid]
+	processSamplesMu.Unlock()
+
+	samples, ret := device.GetProcessUtilization(since)
+	if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_FOUND {
+		log.Printf("Unable to get process utilization for device %s: %v", uuid, nvml.ErrorString(ret))
+		return
+	}
+
+	// Keep the newest sample of each process
+	latest := make(map[uint32]nvml.ProcessUtilizationSample)
+	newest := since
+	for _, sample := range samples {
+		if sample.TimeStamp > latest[sample.Pid].TimeStamp {
+			latest[sample.Pid] = sample
+		}
+		if sample.TimeStamp > newest {
+			newest = sample.TimeStamp
+		}
+	}
+	processSamplesMu.Lock()
+	lastProcessSample[uuid] = newest
+	processSamplesMu.Unlock()
+
+	podSM := make(map[string]uint32, len(podProcesses))
+	var totalSM uint32
+	for key, pids := range podProcesses {
+		for _, pid := range pids {
+			podSM[key] += latest[pid].SmUtil
+		}
+		totalSM += podSM[key]
+	}
+
+	for key, sm := range podSM {
+		share := 0.0
+		if totalSM > 0 {
+			share = float64(utilization.Gpu) * float64(sm) / float64(totalSM)
+		}
+		pod := pods.pods[key].pod
+		podGpuTimeSliceShare.WithLabelValues(pod.Namespace, pod.Name, gpuIndex, uuid).Set(roundPercent(share))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readCollectToken reads the bearer token for /collect from
+// -collect-token-file. An empty path disables the endpoint.
+func readCollectToken() (string, error) {
+	if *collectTokenFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(*collectTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", *collectTokenFile)
+	}
+	return token, nil
+}
+
+// collectHandler runs a collection cycle on POST /collect and answers once
+// it completed. Requests must carry the token as "Authorization: Bearer".
+// Only one triggered cycle runs at a time; concurrent triggers are refused.
+func collectHandler(token string, cycle func() bool) http.HandlerFunc {
+	var triggerMu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !triggerMu.TryLock() {
+			http.Error(w, "a triggered collection cycle is already running", http.StatusConflict)
+			return
+		}
+		defer triggerMu.Unlock()
+
+		if !cycle() {
+			http.Error(w, "collection cycle failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}